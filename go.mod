@@ -3,7 +3,8 @@ module github.com/morgine/wechat_sdk
 go 1.15
 
 require (
-	github.com/go-redis/redis/v8 v8.4.0 // indirect
+	github.com/alicebob/miniredis/v2 v2.14.3
+	github.com/go-redis/redis/v8 v8.4.0
 	github.com/google/go-querystring v1.0.0
-	github.com/morgine/log v0.0.0-20200723085359-3eb4c2be1006 // indirect
+	github.com/mattn/go-sqlite3 v1.14.6
 )
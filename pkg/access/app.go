@@ -25,6 +25,25 @@ func GetAppAccessToken(appid, appSecret string) (token *AppAccessToken, err erro
 	}
 }
 
+// 获取稳定版接口调用凭据, 与 GetAppAccessToken 获取的 token 相互独立, 多个服务分别获取时不会导致对方 token 失效.
+// 普通模式下, token 有效期内重复获取将返回相同 token; forceRefresh 为 true 时强制刷新, 上一个 token 在 5 分钟
+// 后失效, 强制刷新每天限制 20 次, 且两次强制刷新需间隔 30 秒
+func GetStableAccessToken(appid, appSecret string, forceRefresh bool) (token *AppAccessToken, err error) {
+	data := map[string]interface{}{
+		"grant_type":    "client_credential",
+		"appid":         appid,
+		"secret":        appSecret,
+		"force_refresh": forceRefresh,
+	}
+	token = &AppAccessToken{}
+	err = pkg.PostSchema(pkg.KindJson, "https://api.weixin.qq.com/cgi-bin/stable_token", data, token)
+	if err != nil {
+		return nil, err
+	} else {
+		return token, nil
+	}
+}
+
 func GetAppTicket(accessToken string) (ticket *AppTicket, err error) {
 	uri := "https://api.weixin.qq.com/cgi-bin/ticket/getticket?type=jsapi&access_token=" + accessToken
 	ticket = &AppTicket{}
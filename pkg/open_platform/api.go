@@ -105,20 +105,35 @@ type ComponentLoginPageOptions struct {
 	// 第三方平台开发者可以使用本字段来控制授权的帐号类型。
 	//
 	// 注意: AuthType 与 BizAppid 互斥
-	AuthType string `url:"auth_type"`
+	AuthType string `url:"auth_type,omitempty"`
 
 	// 指定授权唯一的小程序或公众号
 	//
 	// 注意: AuthType 与 BizAppid 互斥
-	BizAppid string `url:"biz_appid"`
+	BizAppid string `url:"biz_appid,omitempty"`
 }
 
+// 要授权的帐号类型
+const (
+	AuthTypeOfficialAccount = "1" // 仅展示公众号
+	AuthTypeMiniProgram     = "2" // 仅展示小程序
+	AuthTypeAll             = "3" // 公众号和小程序都展示
+)
+
 // 生成公众号授权地址
 func ComponentLoginPage(ao *ComponentLoginPageOptions) string {
 	vs, _ := query.Values(ao)
 	return "https://mp.weixin.qq.com/cgi-bin/componentloginpage?" + vs.Encode()
 }
 
+// 生成移动端授权链接, 需在微信客户端中打开
+func ComponentBindPage(ao *ComponentLoginPageOptions) string {
+	vs, _ := query.Values(ao)
+	vs.Set("action", "bindcomponent")
+	vs.Set("no_scan", "1")
+	return "https://open.weixin.qq.com/wxaopen/safe/bindcomponent?" + vs.Encode() + "#wechat_redirect"
+}
+
 // 授权成功之后会跳转到回调 Uri, 且带上 auth code 信息.
 // 授权成功之后还会发送事件信息到服务器, 事件信息中也会带上 code 信息.
 // code 有过期时间, 需要及时用于换取授权权限信息以及 accesss token.
@@ -134,6 +149,17 @@ type FuncScope struct {
 	FuncscopeCategory Info `json:"funcscope_category"`
 }
 
+// 公众号权限集 id, 见 AuthorizerInfo.FuncInfo
+const (
+	FuncScopeMessage  = 1  // 消息管理权限
+	FuncScopeUser     = 2  // 用户管理权限
+	FuncScopeAccount  = 3  // 帐号服务权限
+	FuncScopeWebPage  = 4  // 网页服务权限
+	FuncScopeMassSend = 7  // 群发与通知权限
+	FuncScopeMaterial = 11 // 素材管理权限
+	FuncScopeMenu     = 15 // 自定义菜单权限
+)
+
 type Info struct {
 	ID int `json:"id"`
 }
@@ -261,6 +287,9 @@ type AuthorizerInfo struct {
 
 	// APP 简介
 	Signature string `json:"signature"`
+
+	// 授权给开发者的权限集列表, 该字段来自授权信息(authorization_info), 由调用者在获取授权方信息后填充
+	FuncInfo []*FuncScope `json:"func_info,omitempty"`
 }
 
 type Authorizer struct {
@@ -0,0 +1,110 @@
+package src
+
+import (
+	"errors"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"sort"
+	"strings"
+)
+
+// 公众号查询条件, 未设置的条件不参与过滤
+type AppQuery struct {
+	ServiceTypes []int  // 公众号类型, 见 open_platform.AuthorizerInfo.ServiceTypeInfo
+	VerifyTypes  []int  // 认证类型, 见 open_platform.AuthorizerInfo.VerifyTypeInfo
+	Nickname     string // 昵称包含该字符串, 不区分大小写
+	Offset       int
+	Limit        int // 为 0 时不限制数量
+}
+
+// 判断公众号是否满足查询条件(不包含分页条件)
+func (q *AppQuery) Match(app *open_platform.AuthorizerInfo) bool {
+	if len(q.ServiceTypes) > 0 && !containsInfo(q.ServiceTypes, app.ServiceTypeInfo) {
+		return false
+	}
+	if len(q.VerifyTypes) > 0 && !containsInfo(q.VerifyTypes, app.VerifyTypeInfo) {
+		return false
+	}
+	if q.Nickname != "" && !strings.Contains(strings.ToLower(app.NickName), strings.ToLower(q.Nickname)) {
+		return false
+	}
+	return true
+}
+
+func containsInfo(ids []int, info *open_platform.Info) bool {
+	var id int
+	if info != nil {
+		id = info.ID
+	}
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+type AppInfo struct {
+	Appid string
+	*open_platform.AuthorizerInfo
+}
+
+type AppList struct {
+	Total int        // 满足条件的公众号总数
+	Apps  []*AppInfo // 当前页的公众号, 按 appid 排序
+}
+
+// 可选接口, AppStorage 实现该接口时由存储器查询公众号,
+// 否则将列出所有 appid(见 AppidLister) 并逐个读取公众号信息进行过滤
+type AppSearcher interface {
+	SearchApps(query *AppQuery) (*AppList, error)
+}
+
+// AppStorage 既未实现 AppSearcher 也未实现 AppidLister 时无法查询公众号
+var ErrAppListUnsupported = errors.New("app storage must implement AppSearcher or AppidLister to list apps")
+
+// 查询已保存的公众号, AppStorage 须实现 AppSearcher 或 AppidLister, 否则返回 ErrAppListUnsupported
+func (oc *OpenClient) ListApps(query *AppQuery) (*AppList, error) {
+	if query == nil {
+		query = &AppQuery{}
+	}
+	if searcher, ok := oc.configs.AppStorage.(AppSearcher); ok {
+		return searcher.SearchApps(query)
+	}
+	lister, ok := oc.configs.AppStorage.(AppidLister)
+	if !ok {
+		return nil, ErrAppListUnsupported
+	}
+	appids, err := lister.GetAppids()
+	if err != nil {
+		return nil, err
+	}
+	apps := make([]*AppInfo, 0, len(appids))
+	for _, appid := range appids {
+		app, err := oc.configs.AppStorage.GetAppInfo(appid)
+		if err != nil {
+			return nil, err
+		}
+		if app != nil {
+			apps = append(apps, &AppInfo{Appid: appid, AuthorizerInfo: app})
+		}
+	}
+	return FilterApps(apps, query), nil
+}
+
+// 按 appid 排序并过滤公众号, 返回 query 指定的分页, 用于在内存中实现 AppSearcher
+func FilterApps(apps []*AppInfo, query *AppQuery) *AppList {
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Appid < apps[j].Appid
+	})
+	list := &AppList{}
+	for _, app := range apps {
+		if !query.Match(app.AuthorizerInfo) {
+			continue
+		}
+		if list.Total >= query.Offset && (query.Limit <= 0 || len(list.Apps) < query.Limit) {
+			list.Apps = append(list.Apps, app)
+		}
+		list.Total++
+	}
+	return list
+}
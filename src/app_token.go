@@ -0,0 +1,121 @@
+package src
+
+import (
+	"github.com/morgine/wechat_sdk/pkg/access"
+)
+
+// 公众号 access token 管理器, 通过 appid 及 appsecret 获取 access token, 并缓存至存储器中,
+// 用于自行管理的公众号(非第三方平台授权)
+type AppTokenManager struct {
+	configs *AppTokenConfigs
+	storage ComponentStorage
+	flights flightGroup
+}
+
+type AppTokenConfigs struct {
+	Appid    string
+	Secret   string
+	Storage  AccessStorage // token 存储器, 为 nil 时使用内存存储器
+	Strategy TokenStrategy // token 获取方式, 默认为 TokenStrategyClientCredential
+	Locker   Locker        // 分布式锁, 多实例部署时保证同一时间只有一个实例刷新 token, 为 nil 时只在进程内合并刷新请求
+}
+
+// access token 获取方式
+type TokenStrategy int
+
+const (
+	// 通过 /cgi-bin/token 接口获取, 每次获取都会使之前的 token 失效, 适用于只有一个服务获取 token 的情况
+	TokenStrategyClientCredential TokenStrategy = iota
+
+	// 通过 /cgi-bin/stable_token 接口获取, 有效期内多个服务获取到的是同一个 token, 不会相互覆盖.
+	// AppTokenManager.Refresh 将使用 force_refresh 模式
+	TokenStrategyStable
+)
+
+func NewAppTokenManager(configs *AppTokenConfigs) *AppTokenManager {
+	if configs.Storage == nil {
+		configs.Storage = NewMemoryStorage()
+	}
+	return &AppTokenManager{
+		configs: configs,
+		storage: NewComponentStorage(configs.Appid, configs.Storage),
+	}
+}
+
+// 获得 access token, 过期时自动刷新, 同一时间只有一个刷新请求
+func (m *AppTokenManager) GetAccessToken() (string, error) {
+	token, valid, err := m.load()
+	if err != nil {
+		return "", err
+	}
+	if valid {
+		return token, nil
+	}
+	return m.flights.do("access_token", func() (string, error) {
+		return lockedRefresh(m.configs.Locker, m.configs.Appid+"_access_token_lock", m.load, func() (string, error) {
+			return m.refresh(false)
+		})
+	})
+}
+
+// 强制刷新 access token, 用于 access token 被其他服务刷新而失效的情况. 与 GetAccessToken 共用刷新请求及分布式锁,
+// 等待期间 token 已被其他请求或实例刷新时直接返回新 token
+func (m *AppTokenManager) Refresh() (string, error) {
+	stale, _, err := m.load()
+	if err != nil {
+		return "", err
+	}
+	load := func() (string, bool, error) {
+		token, valid, err := m.load()
+		return token, valid && token != stale, err
+	}
+	return m.flights.do("access_token", func() (string, error) {
+		return lockedRefresh(m.configs.Locker, m.configs.Appid+"_access_token_lock", load, func() (string, error) {
+			return m.refresh(true)
+		})
+	})
+}
+
+// 读取已保存的 access token
+func (m *AppTokenManager) load() (token string, valid bool, err error) {
+	data, err := m.storage.GetAccessToken()
+	if err != nil {
+		return "", false, err
+	}
+	if data == nil || data.ExpiredAt < Now().Unix() {
+		return "", false, nil
+	}
+	return data.Value, true, nil
+}
+
+func (m *AppTokenManager) refresh(force bool) (string, error) {
+	var accessToken *access.AppAccessToken
+	var err error
+	switch m.configs.Strategy {
+	case TokenStrategyStable:
+		accessToken, err = access.GetStableAccessToken(m.configs.Appid, m.configs.Secret, force)
+	default:
+		accessToken, err = access.GetAppAccessToken(m.configs.Appid, m.configs.Secret)
+	}
+	if err != nil {
+		return "", err
+	}
+	token := &ExpireData{
+		Value:     accessToken.AccessToken,
+		ExpiredAt: Now().Unix() + accessToken.ExpiresIn - (accessToken.ExpiresIn >> 3), // 过期时间提前 1/8
+	}
+	err = m.storage.SaveAccessToken(token)
+	if err != nil {
+		return "", err
+	}
+	return token.Value, nil
+}
+
+// 创建自行管理 access token 的公众号客户端, configs.TokenGetter 将被替换为 AppTokenManager
+func NewAppPublicClient(tokenConfigs *AppTokenConfigs, configs *PublicClientConfigs) *PublicClient {
+	if configs.Appid == "" {
+		configs.Appid = tokenConfigs.Appid
+	}
+	configs.TokenGetter = NewAppTokenManager(tokenConfigs).GetAccessToken
+	return NewPublicClient(configs)
+}
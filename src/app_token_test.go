@@ -0,0 +1,143 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAppTokenManager(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		if !strings.HasSuffix(r.URL.Path, "/cgi-bin/token") {
+			return map[string]interface{}{"errcode": 40001, "errmsg": "unexpected request"}
+		}
+		q := r.URL.Query()
+		if q.Get("grant_type") != "client_credential" || q.Get("appid") != "wx_app" || q.Get("secret") != "secret" {
+			return map[string]interface{}{"errcode": 40013, "errmsg": "invalid appid"}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		// 耗时的请求, 确保并发获取时被合并
+		time.Sleep(10 * time.Millisecond)
+		return map[string]interface{}{"access_token": fmt.Sprint("token_", calls), "expires_in": 7200}
+	})
+	storage := NewMemoryStorage()
+	manager := NewAppTokenManager(&AppTokenConfigs{Appid: "wx_app", Secret: "secret", Storage: storage})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := manager.GetAccessToken(); err != nil || token != "token_1" {
+				t.Errorf("need: token_1, got: %s, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("need 1 request, got: %d", calls)
+	}
+	// 已缓存的 token 在其他实例(共用存储器)中可直接使用
+	other := NewAppTokenManager(&AppTokenConfigs{Appid: "wx_app", Secret: "secret", Storage: storage})
+	if token, err := other.GetAccessToken(); err != nil || token != "token_1" || calls != 1 {
+		t.Fatalf("need cached token_1, got: %s, %v", token, err)
+	}
+	// 过期时间提前 1/8, 即 6300 秒后刷新
+	runAt(Now().Add(6299*time.Second), func() {
+		if token, _ := manager.GetAccessToken(); token != "token_1" {
+			t.Errorf("token should be cached, got: %s", token)
+		}
+	})
+	runAt(Now().Add(6301*time.Second), func() {
+		if token, _ := manager.GetAccessToken(); token != "token_2" {
+			t.Errorf("token should be refreshed, got: %s", token)
+		}
+	})
+	if token, err := manager.Refresh(); err != nil || token != "token_3" {
+		t.Errorf("need: token_3, got: %s, %v", token, err)
+	}
+	if token, _ := manager.GetAccessToken(); token != "token_3" {
+		t.Errorf("need refreshed token_3, got: %s", token)
+	}
+}
+
+func TestNewAppPublicClient(t *testing.T) {
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		return map[string]interface{}{"access_token": "app_token", "expires_in": 7200}
+	})
+	client := NewAppPublicClient(&AppTokenConfigs{Appid: "wx_app", Secret: "secret"}, &PublicClientConfigs{})
+	if client.GetAppid() != "wx_app" {
+		t.Errorf("need appid wx_app, got: %s", client.GetAppid())
+	}
+	if token, err := client.configs.TokenGetter(); err != nil || token != "app_token" {
+		t.Errorf("need: app_token, got: %s, %v", token, err)
+	}
+}
+
+func TestAppTokenManagerStable(t *testing.T) {
+	var requests []map[string]interface{}
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/cgi-bin/stable_token") {
+			return map[string]interface{}{"errcode": 40001, "errmsg": "unexpected request"}
+		}
+		req := map[string]interface{}{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, req)
+		return map[string]interface{}{"access_token": fmt.Sprint("stable_", len(requests)), "expires_in": 7200}
+	})
+	manager := NewAppTokenManager(&AppTokenConfigs{Appid: "wx_app", Secret: "secret", Strategy: TokenStrategyStable})
+	if token, err := manager.GetAccessToken(); err != nil || token != "stable_1" {
+		t.Fatalf("need: stable_1, got: %s, %v", token, err)
+	}
+	if token, err := manager.Refresh(); err != nil || token != "stable_2" {
+		t.Fatalf("need: stable_2, got: %s, %v", token, err)
+	}
+	// 普通获取不强制刷新, Refresh 使用 force_refresh 模式
+	need := `[{"appid":"wx_app","force_refresh":false,"grant_type":"client_credential","secret":"secret"},` +
+		`{"appid":"wx_app","force_refresh":true,"grant_type":"client_credential","secret":"secret"}]`
+	if got := jsonStr(requests); got != need {
+		t.Errorf("need: %s, got: %s", need, got)
+	}
+}
+
+func TestAppTokenManagerRefreshLocked(t *testing.T) {
+	var calls int32
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		n := atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return map[string]interface{}{"access_token": fmt.Sprint("token_", n), "expires_in": 7200}
+	})
+	storage := NewMemoryStorage()
+	if token, err := NewAppTokenManager(&AppTokenConfigs{Appid: "wx_app", Storage: storage}).GetAccessToken(); err != nil || token != "token_1" {
+		t.Fatalf("need: token_1, got: %s, %v", token, err)
+	}
+	// 模拟多个实例同时发现 token 失效, 只有获得锁的实例刷新, 其余实例使用刷新后的 token
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		manager := NewAppTokenManager(&AppTokenConfigs{Appid: "wx_app", Storage: storage, Locker: storage})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if token, err := manager.Refresh(); err != nil || token != "token_2" {
+				t.Errorf("need: token_2, got: %s, %v", token, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if calls != 2 {
+		t.Errorf("need 2 requests, got: %d", calls)
+	}
+}
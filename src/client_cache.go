@@ -0,0 +1,235 @@
+package src
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClientCacheSize  = 10000            // 默认最大缓存的公众号客户端数量
+	DefaultClientCacheTTL   = 10 * time.Minute // 默认公众号信息缓存时间
+	DefaultNegativeCacheTTL = time.Minute      // 默认不存在的公众号缓存时间
+)
+
+// 公众号客户端缓存分片数量
+const clientCacheShards = 32
+
+// 分片的公众号客户端缓存, 不同公众号分布在不同分片中, 减少锁竞争.
+// 数量限制平均分配到各分片, 淘汰最久未使用的客户端在分片内进行
+type shardedClientCache struct {
+	shards []*clientCache
+}
+
+// size 小于等于 0 时不限制数量
+func newShardedClientCache(shards, size int, ttl, negativeTTL time.Duration) *shardedClientCache {
+	c := &shardedClientCache{shards: make([]*clientCache, shards)}
+	if size > 0 {
+		size = (size + shards - 1) / shards
+	}
+	for i := range c.shards {
+		c.shards[i] = newClientCache(size, ttl, negativeTTL)
+	}
+	return c
+}
+
+func (c *shardedClientCache) shard(appid string) *clientCache {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(appid))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+func (c *shardedClientCache) get(appid string) (*PublicClient, bool) {
+	return c.shard(appid).get(appid)
+}
+
+func (c *shardedClientCache) peek(appid string) *PublicClient {
+	return c.shard(appid).peek(appid)
+}
+
+func (c *shardedClientCache) set(appid string, client *PublicClient) {
+	c.shard(appid).set(appid, client)
+}
+
+func (c *shardedClientCache) invalidate(appid string) {
+	c.shard(appid).invalidate(appid)
+}
+
+func (c *shardedClientCache) remove(appid string) {
+	c.shard(appid).remove(appid)
+}
+
+func (c *shardedClientCache) len() (n int) {
+	for _, shard := range c.shards {
+		n += shard.len()
+	}
+	return n
+}
+
+// 公众号客户端缓存, 超过数量限制时淘汰最久未使用的客户端.
+// 客户端过期后重新读取公众号信息并更新到原客户端, 不会丢失客户端中的状态(如等待打标签的用户)
+type clientCache struct {
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	entries     map[string]*list.Element
+	lru         *list.List // 最近使用的在前
+	mu          sync.Mutex
+}
+
+type clientEntry struct {
+	appid     string
+	client    *PublicClient // 为 nil 表示公众号不存在
+	expiredAt time.Time
+}
+
+func newClientCache(size int, ttl, negativeTTL time.Duration) *clientCache {
+	return &clientCache{
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+}
+
+// 获得客户端, fresh 为 false 时表示缓存不存在或已过期, 过期的客户端仍会返回以便更新
+func (c *clientCache) get(appid string) (client *PublicClient, fresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[appid]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*clientEntry)
+	return entry.client, Now().Before(entry.expiredAt)
+}
+
+// 获得客户端, 不更新使用记录, 不检查过期时间
+func (c *clientCache) peek(appid string) *PublicClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[appid]; ok {
+		return elem.Value.(*clientEntry).client
+	}
+	return nil
+}
+
+// 缓存客户端, client 为 nil 时缓存公众号不存在的结果
+func (c *clientCache) set(appid string, client *PublicClient) {
+	ttl := c.ttl
+	if client == nil {
+		ttl = c.negativeTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &clientEntry{appid: appid, client: client, expiredAt: Now().Add(ttl)}
+	if elem, ok := c.entries[appid]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[appid] = c.lru.PushFront(entry)
+	for c.size > 0 && c.lru.Len() > c.size {
+		elem := c.lru.Back()
+		c.lru.Remove(elem)
+		delete(c.entries, elem.Value.(*clientEntry).appid)
+	}
+}
+
+// 使缓存过期, 下次获取时重新读取公众号信息
+func (c *clientCache) invalidate(appid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[appid]; ok {
+		elem.Value.(*clientEntry).expiredAt = time.Time{}
+	}
+}
+
+func (c *clientCache) remove(appid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[appid]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, appid)
+	}
+}
+
+func (c *clientCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// 合并同一公众号的客户端加载请求
+type clientFlightGroup struct {
+	calls map[string]*clientCall
+	mu    sync.Mutex
+}
+
+type clientCall struct {
+	wg     sync.WaitGroup
+	client *PublicClient
+	err    error
+}
+
+// 执行 fn, 同一 key 同时只执行一次, 其他调用者等待并共享结果
+func (g *clientFlightGroup) do(key string, fn func() (*PublicClient, error)) (*PublicClient, error) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.client, call.err
+	}
+	call := g.start(key)
+	g.mu.Unlock()
+	g.run(key, call, fn)
+	return call.client, call.err
+}
+
+// 异步执行 fn, 同一 key 正在执行时忽略. fn 返回错误或 panic 时调用 onError
+func (g *clientFlightGroup) goDo(key string, fn func() (*PublicClient, error), onError func(err error)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.calls[key]; ok {
+		return
+	}
+	call := g.start(key)
+	go func() {
+		g.run(key, call, func() (client *PublicClient, err error) {
+			defer func() {
+				if e := recover(); e != nil {
+					err = fmt.Errorf("load client %s panic: %v", key, e)
+				}
+			}()
+			return fn()
+		})
+		if call.err != nil {
+			onError(call.err)
+		}
+	}()
+}
+
+// 调用者需持有锁
+func (g *clientFlightGroup) start(key string) *clientCall {
+	if g.calls == nil {
+		g.calls = map[string]*clientCall{}
+	}
+	call := &clientCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	return call
+}
+
+func (g *clientFlightGroup) run(key string, call *clientCall, fn func() (*PublicClient, error)) {
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+	call.client, call.err = fn()
+}
@@ -0,0 +1,301 @@
+package src
+
+import (
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientCache(t *testing.T) {
+	storage := NewMemoryStorage()
+	oc := newTestOpenClient(t, &OpenClientConfigs{AppStorage: storage, ClientCacheSize: 2})
+	// 使用单个分片以便测试淘汰顺序
+	oc.clients = newShardedClientCache(1, 2, DefaultClientCacheTTL, DefaultNegativeCacheTTL)
+	for _, appid := range []string{"wx_a", "wx_b", "wx_c"} {
+		if err := storage.SaveAppInfo(appid, &open_platform.AuthorizerInfo{NickName: appid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, _ := oc.GetClient("wx_a")
+	_, _ = oc.GetClient("wx_b")
+	_, _ = oc.GetClient("wx_a")
+	_, _ = oc.GetClient("wx_c")
+	// wx_b 最久未使用, 被淘汰
+	if oc.clients.len() != 2 || oc.clients.peek("wx_b") != nil || oc.clients.peek("wx_a") != a {
+		t.Fatalf("wx_b should be evicted")
+	}
+
+	// 过期后返回原客户端, 并在后台重新读取公众号信息更新到原客户端
+	_ = storage.SaveAppInfo("wx_a", &open_platform.AuthorizerInfo{NickName: "renamed"})
+	if client, _ := oc.GetClient("wx_a"); client.GetAppInfo().NickName != "wx_a" {
+		t.Errorf("client should be cached")
+	}
+	runAt(Now().Add(DefaultClientCacheTTL+time.Second), func() {
+		client, err := oc.GetClient("wx_a")
+		if err != nil || client != a {
+			t.Errorf("need stale client, got: %v, %v", client, err)
+		}
+		waitFor(t, func() bool {
+			return a.GetAppInfo().NickName == "renamed" && idle(&oc.clientFlights)
+		})
+	})
+
+	// 不存在的公众号缓存 NegativeCacheTTL
+	if client, err := oc.GetClient("wx_new"); err != nil || client != nil {
+		t.Fatalf("need nil client, got: %v, %v", client, err)
+	}
+	_ = storage.SaveAppInfo("wx_new", &open_platform.AuthorizerInfo{NickName: "wx_new"})
+	if client, _ := oc.GetClient("wx_new"); client != nil {
+		t.Errorf("negative result should be cached")
+	}
+	runAt(Now().Add(DefaultNegativeCacheTTL+time.Second), func() {
+		if client, _ := oc.GetClient("wx_new"); client == nil {
+			t.Errorf("negative result should expire")
+		}
+	})
+
+	// 主动使缓存过期
+	_ = storage.SaveAppInfo("wx_new", &open_platform.AuthorizerInfo{NickName: "wx_new_renamed"})
+	oc.InvalidateClient("wx_new")
+	client, _ := oc.GetClient("wx_new")
+	waitFor(t, func() bool {
+		return client.GetAppInfo().NickName == "wx_new_renamed" && idle(&oc.clientFlights)
+	})
+
+	// 更新公众号信息后更新缓存的客户端
+	info := &open_platform.AuthorizerInfo{NickName: "updated"}
+	oc.updateCachedClient("wx_a", info)
+	if a.GetAppInfo() != info {
+		t.Errorf("cached client should be updated")
+	}
+}
+
+func TestGetClientSingleFlight(t *testing.T) {
+	storage := &slowAppStorage{AppStorage: NewMemoryStorage(), release: make(chan struct{})}
+	_ = storage.SaveAppInfo("wx_slow", &open_platform.AuthorizerInfo{NickName: "slow"})
+	oc := newTestOpenClient(t, &OpenClientConfigs{AppStorage: storage})
+	// 预先缓存 wx_fast, wx_slow 的读取阻塞时不影响其他公众号
+	storage.slow = "wx_slow"
+	_ = storage.SaveAppInfo("wx_fast", &open_platform.AuthorizerInfo{NickName: "fast"})
+	clients := make(chan *PublicClient, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			client, _ := oc.GetClient("wx_slow")
+			clients <- client
+		}()
+	}
+	waitFor(t, func() bool {
+		return atomic.LoadInt32(&storage.calls) == 1
+	})
+	if client, err := oc.GetClient("wx_fast"); err != nil || client == nil {
+		t.Fatalf("need fast client, got: %v, %v", client, err)
+	}
+	close(storage.release)
+	first := <-clients
+	for i := 0; i < 2; i++ {
+		if client := <-clients; client != first || client == nil {
+			t.Errorf("clients should be shared")
+		}
+	}
+	if calls := atomic.LoadInt32(&storage.calls); calls != 1 {
+		t.Errorf("need 1 slow call, got: %d", calls)
+	}
+}
+
+// 读取指定公众号时阻塞的存储器
+type slowAppStorage struct {
+	AppStorage
+	slow    string
+	calls   int32
+	release chan struct{}
+}
+
+func (s *slowAppStorage) GetAppInfo(appid string) (*open_platform.AuthorizerInfo, error) {
+	if appid == s.slow {
+		atomic.AddInt32(&s.calls, 1)
+		<-s.release
+	}
+	return s.AppStorage.GetAppInfo(appid)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 判断没有正在加载的客户端
+func idle(g *clientFlightGroup) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.calls) == 0
+}
+
+// 读取公众号信息之后阻塞的存储器, 只阻塞第一次读取
+type staleAppStorage struct {
+	AppStorage
+	calls   int32
+	release chan struct{}
+}
+
+func (s *staleAppStorage) GetAppInfo(appid string) (*open_platform.AuthorizerInfo, error) {
+	info, err := s.AppStorage.GetAppInfo(appid)
+	if atomic.AddInt32(&s.calls, 1) == 1 {
+		<-s.release
+	}
+	return info, err
+}
+
+func TestGetClientUnauthorized(t *testing.T) {
+	storage := &staleAppStorage{AppStorage: NewMemoryStorage(), release: make(chan struct{})}
+	_ = storage.SaveAppInfo("wx_app", &open_platform.AuthorizerInfo{NickName: "app"})
+	oc := newTestOpenClient(t, &OpenClientConfigs{AppStorage: storage})
+	clients := make(chan *PublicClient, 1)
+	go func() {
+		client, _ := oc.GetClient("wx_app")
+		clients <- client
+	}()
+	waitFor(t, func() bool {
+		return atomic.LoadInt32(&storage.calls) == 1
+	})
+	// 加载读取到公众号信息之后取消授权, 加载结果不应被缓存
+	err := oc.setNotify(&open_platform.AuthorizationNotify{InfoType: open_platform.EvtUnauthorized, AuthorizerAppid: "wx_app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(storage.release)
+	if client := <-clients; client != nil {
+		t.Errorf("need nil client, got: %v", client)
+	}
+	if client, err := oc.GetClient("wx_app"); err != nil || client != nil {
+		t.Errorf("need nil client, got: %v, %v", client, err)
+	}
+}
+
+func TestLoadClientGeneration(t *testing.T) {
+	storage := &staleAppStorage{AppStorage: NewMemoryStorage(), release: make(chan struct{})}
+	_ = storage.SaveAppInfo("wx_a", &open_platform.AuthorizerInfo{NickName: "a"})
+	oc := newTestOpenClient(t, &OpenClientConfigs{AppStorage: storage})
+	clients := make(chan *PublicClient, 1)
+	go func() {
+		client, _ := oc.GetClient("wx_a")
+		clients <- client
+	}()
+	waitFor(t, func() bool {
+		return atomic.LoadInt32(&storage.calls) == 1
+	})
+	// 其他公众号的移除及更新不影响正在进行的加载
+	oc.removeClient("wx_b")
+	if err := oc.saveAppInfo("wx_c", &open_platform.AuthorizerInfo{NickName: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	close(storage.release)
+	if client := <-clients; client == nil || client.GetAppInfo().NickName != "a" {
+		t.Fatalf("need client a, got: %v", client)
+	}
+	if calls := atomic.LoadInt32(&storage.calls); calls != 1 {
+		t.Errorf("need 1 call, got: %d", calls)
+	}
+
+	// 加载期间更新同一公众号时重新读取
+	storage.calls, storage.release = 0, make(chan struct{})
+	go func() {
+		client, _ := oc.GetClient("wx_c")
+		clients <- client
+	}()
+	waitFor(t, func() bool {
+		return atomic.LoadInt32(&storage.calls) == 1
+	})
+	if err := oc.saveAppInfo("wx_c", &open_platform.AuthorizerInfo{NickName: "renamed"}); err != nil {
+		t.Fatal(err)
+	}
+	close(storage.release)
+	if client := <-clients; client == nil || client.GetAppInfo().NickName != "renamed" {
+		t.Fatalf("need renamed client, got: %v", client)
+	}
+
+	// 持续被移除时有限次重试
+	removing := &removingAppStorage{AppStorage: storage, oc: oc}
+	oc.configs.AppStorage = removing
+	if _, err := oc.GetClient("wx_d"); err == nil {
+		t.Error("need error")
+	}
+	if removing.calls != maxClientLoadRetries+1 || len(oc.clientGens) != 0 {
+		t.Errorf("unexpected calls: %d, gens: %v", removing.calls, oc.clientGens)
+	}
+}
+
+// 每次读取公众号信息时都移除客户端的存储器
+type removingAppStorage struct {
+	AppStorage
+	oc    *OpenClient
+	calls int
+}
+
+func (s *removingAppStorage) GetAppInfo(appid string) (*open_platform.AuthorizerInfo, error) {
+	s.calls++
+	s.oc.removeClient(appid)
+	return s.AppStorage.GetAppInfo(appid)
+}
+
+func TestClientSharedStores(t *testing.T) {
+	storage := NewMemoryStorage()
+	_ = storage.SaveAppInfo("wx_app", &open_platform.AuthorizerInfo{NickName: "app"})
+	oc := newTestOpenClient(t, &OpenClientConfigs{AppStorage: storage})
+	a, _ := oc.GetClient("wx_app")
+	ctx := &Context{Openid: "openid", client: a}
+	if err := ctx.SetStep("step"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WaitBatchTagging(1, 10, "openid"); err != nil {
+		t.Fatal(err)
+	}
+	// 客户端被移除(如缓存淘汰)后重新创建, 会话及等待打标签的用户不会丢失
+	oc.removeClient("wx_app")
+	b, _ := oc.GetClient("wx_app")
+	if b == nil || b == a {
+		t.Fatal("need new client")
+	}
+	session, err := b.configs.SessionStorage.GetSession("wx_app", "openid")
+	if err != nil || session == nil || session.Step != "step" {
+		t.Errorf("session lost: %+v, %v", session, err)
+	}
+	if b.configs.DedupStorage != a.configs.DedupStorage {
+		t.Error("dedup storage should be shared")
+	}
+	if users := b.waitTags.users["wx_app"][1]; jsonStr(users) != `["openid"]` {
+		t.Errorf("wait tag users lost: %v", users)
+	}
+}
+
+func TestClientFlightGoDoPanic(t *testing.T) {
+	var g clientFlightGroup
+	errs := make(chan error, 1)
+	g.goDo("wx_app", func() (*PublicClient, error) {
+		panic("boom")
+	}, func(err error) {
+		errs <- err
+	})
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("panic not reported")
+	}
+	waitFor(t, func() bool {
+		return idle(&g)
+	})
+	// 后台加载使用的默认 Logger
+	if oc := newTestOpenClient(t, &OpenClientConfigs{}); oc.configs.Logger == nil {
+		t.Error("need default logger")
+	}
+}
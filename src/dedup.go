@@ -0,0 +1,78 @@
+package src
+
+import (
+	"bytes"
+	"github.com/morgine/wechat_sdk/pkg/message"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 默认消息去重记录保存时间, 微信服务器最多重试 3 次, 每次间隔 5 秒
+const DefaultDedupTTL = time.Minute
+
+const (
+	dedupProcessing byte = '0' // 消息处理中
+	dedupReplied    byte = '1' // 消息已回复, 之后的数据为回复内容
+)
+
+// 获得消息去重 key, 普通消息使用 MsgId, 事件消息使用 FromUserName + CreateTime + Event
+func dedupKey(appid string, msg *message.ServerMessage, data message.ServerMessageData) string {
+	if msg.MsgType != message.ServerMsgTypeEvent && msg.MsgId != 0 {
+		return "msg_dedup_" + appid + "_" + strconv.FormatInt(msg.MsgId, 10)
+	}
+	key := "msg_dedup_" + appid + "_" + msg.FromUserName + "_" + strconv.FormatInt(msg.CreateTime, 10)
+	if evt, err := data.MarshalEvent(); err == nil {
+		key += "_" + string(evt.Event)
+	}
+	return key
+}
+
+// 检查消息是否重复, 如果重复则响应缓存的回复内容并返回 true, 否则标记消息为处理中
+func (pc *PublicClient) replyDuplicate(key string, w http.ResponseWriter) bool {
+	cached, err := pc.configs.DedupStorage.Get(key)
+	if err != nil {
+		pc.configs.Logger.Println(err)
+		return false
+	}
+	if len(cached) > 0 {
+		if cached[0] == dedupReplied && len(cached) > 1 {
+			w.Header().Set("Content-Type", "application/xml;charset=UTF-8")
+			_, _ = w.Write(cached[1:])
+		} else {
+			// 消息正在处理或没有回复内容, 直接响应 success, 防止再次重试
+			_, _ = w.Write([]byte("success"))
+		}
+		return true
+	}
+	err = pc.configs.DedupStorage.Set(key, []byte{dedupProcessing}, pc.configs.DedupTTL)
+	if err != nil {
+		pc.configs.Logger.Println(err)
+	}
+	return false
+}
+
+// 缓存消息回复内容
+func (pc *PublicClient) saveReply(key string, body []byte) {
+	err := pc.configs.DedupStorage.Set(key, append([]byte{dedupReplied}, body...), pc.configs.DedupTTL)
+	if err != nil {
+		pc.configs.Logger.Println(err)
+	}
+}
+
+// 记录响应内容
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (b *bodyRecorder) Write(data []byte) (int, error) {
+	b.body.Write(data)
+	return b.ResponseWriter.Write(data)
+}
+
+func (b *bodyRecorder) Flush() {
+	if f, ok := b.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
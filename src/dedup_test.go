@@ -0,0 +1,33 @@
+package src
+
+import (
+	"github.com/morgine/wechat_sdk/pkg/message"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReplyDuplicate(t *testing.T) {
+	client := NewPublicClient(&PublicClientConfigs{Appid: "wx_test"})
+	msg := &message.ServerMessage{FromUserName: "openid", CreateTime: 1600000000, MsgType: message.ServerMsgTypeText, MsgId: 100}
+	key := dedupKey(client.GetAppid(), msg, nil)
+
+	if client.replyDuplicate(key, httptest.NewRecorder()) {
+		t.Fatal("first message should not be duplicate")
+	}
+	// 处理中的消息直接响应 success
+	recorder := httptest.NewRecorder()
+	if !client.replyDuplicate(key, recorder) || recorder.Body.String() != "success" {
+		t.Fatalf("need: success, got: %s", recorder.Body.String())
+	}
+	client.saveReply(key, []byte("<xml>reply</xml>"))
+	recorder = httptest.NewRecorder()
+	if !client.replyDuplicate(key, recorder) || recorder.Body.String() != "<xml>reply</xml>" {
+		t.Fatalf("need cached reply, got: %s", recorder.Body.String())
+	}
+
+	evt := []byte("<xml><Event><![CDATA[subscribe]]></Event></xml>")
+	evtMsg := &message.ServerMessage{FromUserName: "openid", CreateTime: 1600000000, MsgType: message.ServerMsgTypeEvent}
+	if got, need := dedupKey("wx_test", evtMsg, evt), "msg_dedup_wx_test_openid_1600000000_subscribe"; got != need {
+		t.Errorf("need: %s, got: %s", need, got)
+	}
+}
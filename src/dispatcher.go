@@ -1,29 +1,73 @@
 package src
 
 import (
+	"context"
 	"github.com/morgine/wechat_sdk/pkg/message"
+	"net/http"
+	"time"
 )
 
 type Context struct {
 	ResponseWriter
-	Openid string // 用户 openid
-	client *PublicClient
-	values map[string]interface{}
+	Openid     string // 用户 openid
+	ToUserName string // 公众号原始 ID
+	CreateTime int64  // 消息创建时间
+	MsgId      int64  // 消息 id, 事件消息为 0
+	client     *PublicClient
+	values     map[string]interface{}
+	session    *Session
+	header     *message.ServerMessage
+	data       message.ServerMessageData
+	request    *http.Request
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
 func newContext(
 	client *PublicClient,
-	openid string,
+	msg *message.ServerMessage,
+	data message.ServerMessageData,
+	r *http.Request,
 	w ResponseWriter,
 ) *Context {
+	var parent context.Context = context.Background()
+	if r != nil {
+		parent = detachedContext{r.Context()}
+	}
+	c, cancel := context.WithCancel(parent)
 	return &Context{
 		ResponseWriter: w,
-		Openid:         openid,
+		Openid:         msg.FromUserName,
+		ToUserName:     msg.ToUserName,
+		CreateTime:     msg.CreateTime,
+		MsgId:          msg.MsgId,
 		client:         client,
 		values:         map[string]interface{}{},
+		header:         msg,
+		data:           data,
+		request:        r,
+		ctx:            c,
+		cancel:         cancel,
 	}
 }
 
+// 保留请求 context 中的值, 但不随请求结束而取消
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
 func (ctx *Context) Get(key string) (value interface{}, ok bool) {
 	value, ok = ctx.values[key]
 	return
@@ -37,10 +81,106 @@ func (ctx *Context) Client() *PublicClient {
 	return ctx.client
 }
 
+// 获得公众号 appid
+func (ctx *Context) Appid() string {
+	return ctx.client.GetAppid()
+}
+
+// 获得消息头
+func (ctx *Context) Header() *message.ServerMessage {
+	return ctx.header
+}
+
+// 获得解密后的原始 xml 消息
+func (ctx *Context) Raw() message.ServerMessageData {
+	return ctx.data
+}
+
+// 获得原始请求
+func (ctx *Context) Request() *http.Request {
+	return ctx.request
+}
+
+// 获得处理器的 context.Context, 包含请求 context 中的值, 在处理器返回时取消.
+// 被动回复窗口关闭(超时)之后请求即结束, 但该 context 仍然有效, 可用于延迟回复
+func (ctx *Context) Context() context.Context {
+	return ctx.ctx
+}
+
+// 向当前用户发送客服消息
+func (ctx *Context) SendCustomerMessage(msg *message.CustomerMessage) error {
+	token, err := ctx.client.tokenFor("SendCustomerMessage")
+	if err != nil {
+		return err
+	}
+	return msg.Send(token, ctx.Openid)
+}
+
+// 为当前用户打标签
+func (ctx *Context) TagUser(tagID int) error {
+	return ctx.client.BatchTagging(tagID, []string{ctx.Openid})
+}
+
+// 为当前用户取消标签
+func (ctx *Context) UntagUser(tagID int) error {
+	return ctx.client.BatchUntagging(tagID, []string{ctx.Openid})
+}
+
+// 将当前用户加入等待标签, 见 PublicClient.WaitBatchTagging
+func (ctx *Context) WaitTagUser(tagID, cacheNum int) error {
+	return ctx.client.WaitBatchTagging(tagID, cacheNum, ctx.Openid)
+}
+
+// 获得当前用户会话, 会话不存在时返回新的空会话, 修改会话之后需调用 SaveSession 保存
+func (ctx *Context) Session() (*Session, error) {
+	if ctx.session == nil {
+		session, err := ctx.client.configs.SessionStorage.GetSession(ctx.client.GetAppid(), ctx.Openid)
+		if err != nil {
+			return nil, err
+		}
+		if session == nil {
+			session = &Session{}
+		}
+		if session.Values == nil {
+			session.Values = map[string]string{}
+		}
+		ctx.session = session
+	}
+	return ctx.session, nil
+}
+
+// 保存当前用户会话, 并重置会话过期时间
+func (ctx *Context) SaveSession() error {
+	session, err := ctx.Session()
+	if err != nil {
+		return err
+	}
+	return ctx.client.configs.SessionStorage.SaveSession(ctx.client.GetAppid(), ctx.Openid, session, ctx.client.configs.SessionTTL)
+}
+
+// 进入对话步骤, 用户之后的消息将被路由到该步骤的处理器
+func (ctx *Context) SetStep(step string) error {
+	session, err := ctx.Session()
+	if err != nil {
+		return err
+	}
+	session.Step = step
+	return ctx.SaveSession()
+}
+
+// 结束并删除当前用户会话
+func (ctx *Context) EndSession() error {
+	ctx.session = nil
+	return ctx.client.configs.SessionStorage.DelSession(ctx.client.GetAppid(), ctx.Openid)
+}
+
 type TextMsgHandler func(msg *message.TextMessage, ctx *Context)
 
 type EventMsgHandler func(msg message.ServerMessageData, evt *message.EventMessage, ctx *Context)
 
+// 对话步骤处理器, 接收用户处于该步骤时的所有消息(包括事件)
+type StepHandler func(msg *message.ServerMessage, data message.ServerMessageData, ctx *Context)
+
 type Music struct {
 	Title        string // 标题(可选)
 	Description  string // 描述(可选)
@@ -59,10 +199,14 @@ type Article struct {
 type Dispatcher struct {
 	textMsgHandlers []TextMsgHandler
 	eventHandlers   map[message.EventType][]EventMsgHandler
+	stepHandlers    map[string]StepHandler
 }
 
 func NewDispatcher() *Dispatcher {
-	return &Dispatcher{eventHandlers: map[message.EventType][]EventMsgHandler{}}
+	return &Dispatcher{
+		eventHandlers: map[message.EventType][]EventMsgHandler{},
+		stepHandlers:  map[string]StepHandler{},
+	}
 }
 
 // 添加事件处理器
@@ -75,19 +219,37 @@ func (d *Dispatcher) SubscribeTextMsg(h TextMsgHandler) {
 	d.textMsgHandlers = append(d.textMsgHandlers, h)
 }
 
+// 添加对话步骤处理器, 用户会话处于该步骤时, 消息只会路由到该处理器, 不再触发文本及事件处理器.
+// 处理器通过 Context.SetStep 切换到下一步骤, 通过 Context.EndSession 结束对话
+func (d *Dispatcher) SubscribeStep(step string, h StepHandler) {
+	d.stepHandlers[step] = h
+}
+
 func (d *Dispatcher) trigger(
 	msg *message.ServerMessage,
 	data message.ServerMessageData,
 	client *PublicClient,
+	r *http.Request,
 	w ResponseWriter,
 ) error {
+	ctx := newContext(client, msg, data, r, w)
+	defer ctx.cancel()
+	if len(d.stepHandlers) > 0 {
+		session, err := ctx.Session()
+		if err != nil {
+			return err
+		}
+		if h, ok := d.stepHandlers[session.Step]; ok && session.Step != "" {
+			h(msg, data, ctx)
+			return nil
+		}
+	}
 	switch msg.MsgType {
 	case message.ServerMsgTypeEvent:
 		eventMsg, err := data.MarshalEvent()
 		if err != nil {
 			return err
 		}
-		ctx := newContext(client, msg.FromUserName, w)
 		if handlers, ok := d.eventHandlers[eventMsg.Event]; ok {
 			for _, h := range handlers {
 				h(data, eventMsg, ctx)
@@ -99,7 +261,6 @@ func (d *Dispatcher) trigger(
 			if err != nil {
 				return err
 			} else {
-				ctx := newContext(client, msg.FromUserName, w)
 				for _, handler := range d.textMsgHandlers {
 					handler(textMsg, ctx)
 				}
@@ -0,0 +1,165 @@
+package src
+
+import (
+	"context"
+	"github.com/morgine/wechat_sdk/pkg/message"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDispatcherStep(t *testing.T) {
+	var got []string
+	d := NewDispatcher()
+	d.SubscribeTextMsg(func(msg *message.TextMessage, ctx *Context) {
+		got = append(got, "text:"+msg.Content)
+		if err := ctx.SetStep("name"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	d.SubscribeStep("name", func(msg *message.ServerMessage, data message.ServerMessageData, ctx *Context) {
+		text, err := data.MarshalTextMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, "step:"+text.Content)
+		session, err := ctx.Session()
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.Values["name"] = text.Content
+		if err = ctx.SaveSession(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	client := NewPublicClient(&PublicClientConfigs{Appid: "wx_test", Dispatcher: d})
+	msg := &message.ServerMessage{FromUserName: "openid", MsgType: message.ServerMsgTypeText}
+	for _, content := range []string{"signup", "morgine"} {
+		data := message.ServerMessageData("<xml><Content><![CDATA[" + content + "]]></Content></xml>")
+		if err := d.trigger(msg, data, client, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if jsonStr(got) != jsonStr([]string{"text:signup", "step:morgine"}) {
+		t.Errorf("unexpected dispatch: %v", got)
+	}
+	session, err := client.configs.SessionStorage.GetSession("wx_test", "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session == nil || session.Step != "name" || session.Values["name"] != "morgine" {
+		t.Errorf("unexpected session: %+v", session)
+	}
+}
+
+type ctxKey struct{}
+
+func TestContextLifetime(t *testing.T) {
+	reqCtx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+	r := newMessageRequest("token", "").WithContext(reqCtx)
+	var handlerCtx context.Context
+	d := NewDispatcher()
+	d.SubscribeTextMsg(func(msg *message.TextMessage, ctx *Context) {
+		// 请求结束(被动回复超时)之后 context 仍然有效
+		cancel()
+		handlerCtx = ctx.Context()
+		if err := handlerCtx.Err(); err != nil {
+			t.Errorf("context cancelled before handler returns: %v", err)
+		}
+		if v := handlerCtx.Value(ctxKey{}); v != "value" {
+			t.Errorf("need request value, got: %v", v)
+		}
+		if ctx.Request() != r {
+			t.Error("unexpected request")
+		}
+	})
+	client := NewPublicClient(&PublicClientConfigs{Appid: "wx_test", Dispatcher: d})
+	msg := &message.ServerMessage{FromUserName: "openid", MsgType: message.ServerMsgTypeText}
+	if err := d.trigger(msg, message.ServerMessageData("<xml></xml>"), client, r, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handlerCtx.Done():
+	default:
+		t.Fatal("context not cancelled after handler returns")
+	}
+	if handlerCtx.Err() != context.Canceled {
+		t.Errorf("need: %v, got: %v", context.Canceled, handlerCtx.Err())
+	}
+}
+
+func TestContextMessage(t *testing.T) {
+	raw := "<xml><ToUserName><![CDATA[gh_test]]></ToUserName><FromUserName><![CDATA[openid]]></FromUserName>" +
+		"<CreateTime>1600000000</CreateTime><MsgType><![CDATA[text]]></MsgType><Content><![CDATA[hi]]></Content>" +
+		"<MsgId>1001</MsgId></xml>"
+	var got *Context
+	d := NewDispatcher()
+	d.SubscribeTextMsg(func(msg *message.TextMessage, ctx *Context) {
+		got = ctx
+	})
+	client := NewPublicClient(&PublicClientConfigs{Appid: "wx_test", Dispatcher: d, MsgVerifyToken: "token"})
+	client.ListenMessage(httptest.NewRecorder(), newMessageRequest("token", raw))
+	if got == nil {
+		t.Fatal("handler not called")
+	}
+	if got.Openid != "openid" || got.ToUserName != "gh_test" || got.CreateTime != 1600000000 || got.MsgId != 1001 {
+		t.Errorf("unexpected context: %+v", got)
+	}
+	if got.Appid() != "wx_test" || got.Client() != client {
+		t.Errorf("unexpected client: %s", got.Appid())
+	}
+	if h := got.Header(); h == nil || h.MsgType != message.ServerMsgTypeText || h.MsgId != 1001 {
+		t.Errorf("unexpected header: %+v", h)
+	}
+	if string(got.Raw()) != raw {
+		t.Errorf("unexpected raw message: %s", got.Raw())
+	}
+}
+
+func TestContextHelpers(t *testing.T) {
+	var calls []string
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		calls = append(calls, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]+" "+strings.TrimSpace(string(body)))
+		return map[string]interface{}{"errcode": 0}
+	})
+	d := NewDispatcher()
+	d.SubscribeTextMsg(func(msg *message.TextMessage, ctx *Context) {
+		steps := []func() error{
+			func() error {
+				return ctx.SendCustomerMessage(&message.CustomerMessage{
+					MsgType: message.CustomerMsgTypeText,
+					Text:    &message.Text{Content: "hello"},
+				})
+			},
+			func() error { return ctx.TagUser(1) },
+			func() error { return ctx.UntagUser(2) },
+			// 等待数量未超过 cacheNum 时不打标签
+			func() error { return ctx.WaitTagUser(3, 1) },
+			func() error { return ctx.WaitTagUser(3, 1) },
+		}
+		for _, step := range steps {
+			if err := step(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	client := NewPublicClient(&PublicClientConfigs{
+		Appid:          "wx_test",
+		Dispatcher:     d,
+		MsgVerifyToken: "token",
+		TokenGetter: func() (string, error) {
+			return "access_token", nil
+		},
+	})
+	client.ListenMessage(httptest.NewRecorder(), newMessageRequest("token", textMessageXML("openid", "hi", 1)))
+	need := []string{
+		`send {"touser":"openid","msgtype":"text","text":{"content":"hello"}}`,
+		`batchtagging {"openid_list":["openid"],"tagid":1}`,
+		`batchuntagging {"openid_list":["openid"],"tagid":2}`,
+		`batchtagging {"openid_list":["openid","openid"],"tagid":3}`,
+	}
+	if jsonStr(calls) != jsonStr(need) {
+		t.Errorf("need: %s, got: %s", jsonStr(need), jsonStr(calls))
+	}
+}
@@ -0,0 +1,292 @@
+package src
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 密钥提供者, 用于加密存储中的 token 及 ticket. 密钥长度须为 16, 24 或 32 字节(AES-128/192/256),
+// id 随密文一同保存, 轮换密钥时只需更换 CurrentKey, 旧密钥保留在 GetKey 中直到所有数据重新写入
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error) // 获得当前用于加密的密钥
+	GetKey(id string) (key []byte, err error)       // 根据 id 获得用于解密的密钥, 密钥不存在时返回错误
+}
+
+type staticKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+// 创建固定密钥提供者, current 为当前加密密钥 id, keys 为所有可用的密钥
+func NewStaticKeyProvider(current string, keys map[string][]byte) (KeyProvider, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q not found", current)
+	}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", id, err)
+		}
+	}
+	return &staticKeyProvider{current: current, keys: keys}, nil
+}
+
+func (s *staticKeyProvider) CurrentKey() (string, []byte, error) {
+	return s.current, s.keys[s.current], nil
+}
+
+func (s *staticKeyProvider) GetKey(id string) ([]byte, error) {
+	if key, ok := s.keys[id]; ok {
+		return key, nil
+	} else {
+		return nil, fmt.Errorf("key %q not found", id)
+	}
+}
+
+// 加密数据前缀, 格式为 enc1.{key id}.{加密的数据密钥}.{加密的数据}
+const encryptedPrefix = "enc1."
+
+var ErrDecrypt = errors.New("failed to decrypt stored data")
+
+type EncryptionConfigs struct {
+	Keys KeyProvider
+	// 允许读取未加密的数据, 用于将已有的存储迁移为加密存储, 数据将在下次写入时加密
+	AllowPlaintext bool
+}
+
+// 信封加密: 每次写入生成随机数据密钥, 使用 AES-GCM 加密数据, 数据密钥再由 KeyProvider 提供的主密钥加密
+type envelope struct {
+	configs *EncryptionConfigs
+}
+
+func (e *envelope) encrypt(plaintext []byte, aad string) (string, error) {
+	id, key, err := e.configs.Keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	dataKey := make([]byte, 32)
+	if _, err = rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	// 数据密钥绑定主密钥 id, 数据绑定 aad, 防止密文被替换到其他位置
+	wrapped, err := seal(key, dataKey, id)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dataKey, plaintext, aad)
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + id + "." + base64.RawURLEncoding.EncodeToString(wrapped) + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (e *envelope) decrypt(value string, aad string) ([]byte, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		if e.configs.AllowPlaintext {
+			return []byte(value), nil
+		} else {
+			return nil, ErrDecrypt
+		}
+	}
+	parts := strings.Split(value[len(encryptedPrefix):], ".")
+	if len(parts) != 3 {
+		return nil, ErrDecrypt
+	}
+	key, err := e.configs.Keys.GetKey(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	dataKey, err := open(key, wrapped, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return open(dataKey, sealed, aad)
+}
+
+func seal(key, plaintext []byte, aad string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, []byte(aad)), nil
+}
+
+func open(key, sealed []byte, aad string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(aad))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type encryptedStorage struct {
+	envelope
+	storage AccessStorage
+}
+
+// 创建加密的 AccessStorage, 所有值均加密后写入 storage, 可用于 NewComponentStorage 等基于 AccessStorage 的存储
+func NewEncryptedStorage(storage AccessStorage, configs *EncryptionConfigs) AccessStorage {
+	return &encryptedStorage{envelope: envelope{configs: configs}, storage: storage}
+}
+
+func (e *encryptedStorage) Set(key string, value []byte, expiration time.Duration) error {
+	if len(value) == 0 {
+		return e.storage.Set(key, value, expiration)
+	}
+	data, err := e.encrypt(value, key)
+	if err != nil {
+		return err
+	}
+	return e.storage.Set(key, []byte(data), expiration)
+}
+
+func (e *encryptedStorage) Get(key string) ([]byte, error) {
+	value, err := e.storage.Get(key)
+	if err != nil || len(value) == 0 {
+		return value, err
+	}
+	return e.decrypt(string(value), key)
+}
+
+type encryptedComponentStorage struct {
+	envelope
+	storage ComponentStorage
+}
+
+// 创建加密的 ComponentStorage, 用于不基于 AccessStorage 实现的存储(如数据库), ticket 及 token 加密后写入 storage,
+// 过期时间不加密, 以便存储根据过期时间清理数据
+func NewEncryptedComponentStorage(storage ComponentStorage, configs *EncryptionConfigs) ComponentStorage {
+	return &encryptedComponentStorage{envelope: envelope{configs: configs}, storage: storage}
+}
+
+func (e *encryptedComponentStorage) encryptString(value, aad string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	return e.encrypt([]byte(value), aad)
+}
+
+func (e *encryptedComponentStorage) decryptString(value, aad string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	data, err := e.decrypt(value, aad)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (e *encryptedComponentStorage) SaveVerifyTicket(ticket string) error {
+	data, err := e.encryptString(ticket, "ticket")
+	if err != nil {
+		return err
+	}
+	return e.storage.SaveVerifyTicket(data)
+}
+
+func (e *encryptedComponentStorage) GetVerifyTicket() (string, error) {
+	ticket, err := e.storage.GetVerifyTicket()
+	if err != nil {
+		return "", err
+	}
+	return e.decryptString(ticket, "ticket")
+}
+
+func (e *encryptedComponentStorage) SaveAccessToken(data *ExpireData) error {
+	value, err := e.encryptString(data.Value, "access_token")
+	if err != nil {
+		return err
+	}
+	return e.storage.SaveAccessToken(&ExpireData{Value: value, ExpiredAt: data.ExpiredAt})
+}
+
+func (e *encryptedComponentStorage) GetAccessToken() (*ExpireData, error) {
+	data, err := e.storage.GetAccessToken()
+	if err != nil || data == nil {
+		return nil, err
+	}
+	value, err := e.decryptString(data.Value, "access_token")
+	if err != nil {
+		return nil, err
+	}
+	return &ExpireData{Value: value, ExpiredAt: data.ExpiredAt}, nil
+}
+
+func (e *encryptedComponentStorage) SaveAppAccessToken(appid string, token *AppAccessToken) error {
+	accessToken, err := e.encryptString(token.AccessToken, "app_access_token_"+appid)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := e.encryptString(token.RefreshToken, "app_refresh_token_"+appid)
+	if err != nil {
+		return err
+	}
+	return e.storage.SaveAppAccessToken(appid, &AppAccessToken{AccessToken: accessToken, ExpireAt: token.ExpireAt, RefreshToken: refreshToken})
+}
+
+func (e *encryptedComponentStorage) GetAppAccessToken(appid string) (*AppAccessToken, error) {
+	token, err := e.storage.GetAppAccessToken(appid)
+	if err != nil || token == nil {
+		return nil, err
+	}
+	accessToken, err := e.decryptString(token.AccessToken, "app_access_token_"+appid)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := e.decryptString(token.RefreshToken, "app_refresh_token_"+appid)
+	if err != nil {
+		return nil, err
+	}
+	return &AppAccessToken{AccessToken: accessToken, ExpireAt: token.ExpireAt, RefreshToken: refreshToken}, nil
+}
+
+// 预授权码不加密, 底层存储未实现 PreAuthCodeStorage 时不缓存
+func (e *encryptedComponentStorage) SavePreAuthCode(data *ExpireData) error {
+	if storage, ok := e.storage.(PreAuthCodeStorage); ok {
+		return storage.SavePreAuthCode(data)
+	}
+	return nil
+}
+
+func (e *encryptedComponentStorage) GetPreAuthCode() (*ExpireData, error) {
+	if storage, ok := e.storage.(PreAuthCodeStorage); ok {
+		return storage.GetPreAuthCode()
+	}
+	return nil, nil
+}
@@ -0,0 +1,57 @@
+package src
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	oldKeys, err := NewStaticKeyProvider("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := NewMemoryStorage()
+	s := NewEncryptedStorage(memory, &EncryptionConfigs{Keys: oldKeys})
+	if err = s.Set("token", []byte("secret"), 0); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := memory.Get("token")
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Fatalf("value should be encrypted, got: %s", raw)
+	}
+
+	// 轮换密钥后, 旧数据仍可读取, 新数据使用新密钥加密
+	newKeys, err := NewStaticKeyProvider("k2", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 16),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = NewEncryptedStorage(memory, &EncryptionConfigs{Keys: newKeys})
+	if value, err := s.Get("token"); err != nil || string(value) != "secret" {
+		t.Errorf("need secret, got: %q, %v", value, err)
+	}
+	if err = s.Set("token2", []byte("secret2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ = memory.Get("token2"); !bytes.HasPrefix(raw, []byte(encryptedPrefix+"k2.")) {
+		t.Errorf("need encrypted by k2, got: %s", raw)
+	}
+
+	// 密文不能被替换到其他 key
+	_ = memory.Set("token3", raw, 0)
+	if _, err = s.Get("token3"); err != ErrDecrypt {
+		t.Errorf("need ErrDecrypt, got: %v", err)
+	}
+
+	// 明文数据仅在 AllowPlaintext 时可读取
+	_ = memory.Set("plain", []byte("plain"), 0)
+	if _, err = s.Get("plain"); err != ErrDecrypt {
+		t.Errorf("need ErrDecrypt, got: %v", err)
+	}
+	s = NewEncryptedStorage(memory, &EncryptionConfigs{Keys: newKeys, AllowPlaintext: true})
+	if value, err := s.Get("plain"); err != nil || string(value) != "plain" {
+		t.Errorf("need plain, got: %q, %v", value, err)
+	}
+}
@@ -0,0 +1,218 @@
+package src
+
+import (
+	"encoding/json"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 文件存储器, 所有数据以 json 格式保存在同一个文件中, 重启后数据不会丢失, 实现了 AccessStorage 及 AppStorage 接口.
+// 写入时先写临时文件再重命名, 保证文件不会损坏; 读写时对 {path}.lock 加文件锁, 多个进程可共用同一个文件(windows 除外).
+// 每次写入都会重写整个文件, 适用于单机及数据量较小的场景
+type FileStorage struct {
+	path string
+	mu   sync.Mutex
+}
+
+type fileData struct {
+	Values map[string]*fileValue                    `json:"values"`
+	Apps   map[string]*open_platform.AuthorizerInfo `json:"apps"`
+}
+
+type fileValue struct {
+	Data      []byte `json:"data"`
+	ExpiredAt int64  `json:"expired_at,omitempty"` // 过期时间, unix 纳秒时间戳, 为 0 时永不过期
+}
+
+func (v *fileValue) expired(now time.Time) bool {
+	return v.ExpiredAt != 0 && v.ExpiredAt <= now.UnixNano()
+}
+
+// 创建文件存储器, 文件不存在时将自动创建
+func NewFileStorage(path string) (*FileStorage, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileStorage{path: path}
+	// 检查文件是否可读写
+	err = fs.update(func(data *fileData) (bool, error) {
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// 加锁并读取文件
+func (fs *FileStorage) view(fn func(data *fileData) error) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	unlock, err := lockFile(fs.path+".lock", false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, err := fs.read()
+	if err != nil {
+		return err
+	}
+	return fn(data)
+}
+
+// 加锁读取文件, 修改之后写入文件, fn 返回 false 时不写入
+func (fs *FileStorage) update(fn func(data *fileData) (changed bool, err error)) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	unlock, err := lockFile(fs.path+".lock", true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, err := fs.read()
+	if err != nil {
+		return err
+	}
+	changed, err := fn(data)
+	if err != nil || !changed {
+		return err
+	}
+	// 写入时顺便清理过期数据
+	now := Now()
+	for key, v := range data.Values {
+		if v.expired(now) {
+			delete(data.Values, key)
+		}
+	}
+	return fs.write(data)
+}
+
+func (fs *FileStorage) read() (*fileData, error) {
+	data := &fileData{}
+	content, err := ioutil.ReadFile(fs.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(content) > 0 {
+		err = json.Unmarshal(content, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if data.Values == nil {
+		data.Values = map[string]*fileValue{}
+	}
+	if data.Apps == nil {
+		data.Apps = map[string]*open_platform.AuthorizerInfo{}
+	}
+	return data, nil
+}
+
+// 原子写入: 写入同目录下的临时文件, 同步到磁盘后重命名
+func (fs *FileStorage) write(data *fileData) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fs.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// 保存数据, expiration 为 0 时永不过期, 小于 0 时表示数据已过期, 将删除已存在的数据
+func (fs *FileStorage) Set(key string, value []byte, expiration time.Duration) error {
+	return fs.update(func(data *fileData) (bool, error) {
+		if expiration < 0 {
+			delete(data.Values, key)
+			return true, nil
+		}
+		v := &fileValue{Data: value}
+		if expiration > 0 {
+			v.ExpiredAt = Now().Add(expiration).UnixNano()
+		}
+		data.Values[key] = v
+		return true, nil
+	})
+}
+
+func (fs *FileStorage) Get(key string) (value []byte, err error) {
+	err = fs.view(func(data *fileData) error {
+		if v, ok := data.Values[key]; ok && !v.expired(Now()) {
+			value = v.Data
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (fs *FileStorage) SaveAppInfo(appid string, app *open_platform.AuthorizerInfo) error {
+	return fs.update(func(data *fileData) (bool, error) {
+		data.Apps[appid] = app
+		return true, nil
+	})
+}
+
+func (fs *FileStorage) GetAppInfo(appid string) (app *open_platform.AuthorizerInfo, err error) {
+	err = fs.view(func(data *fileData) error {
+		app = data.Apps[appid]
+		return nil
+	})
+	return app, err
+}
+
+func (fs *FileStorage) DelAppInfo(appid string) error {
+	return fs.update(func(data *fileData) (bool, error) {
+		_, ok := data.Apps[appid]
+		delete(data.Apps, appid)
+		return ok, nil
+	})
+}
+
+func (fs *FileStorage) DelAppInfoNotIn(appids []string) error {
+	keep := make(map[string]bool, len(appids))
+	for _, appid := range appids {
+		keep[appid] = true
+	}
+	return fs.update(func(data *fileData) (bool, error) {
+		changed := false
+		for appid := range data.Apps {
+			if !keep[appid] {
+				delete(data.Apps, appid)
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+func (fs *FileStorage) GetAppids() (appids []string, err error) {
+	err = fs.view(func(data *fileData) error {
+		for appid := range data.Apps {
+			appids = append(appids, appid)
+		}
+		return nil
+	})
+	sort.Strings(appids)
+	return appids, err
+}
@@ -0,0 +1,60 @@
+package src
+
+import (
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "wechat.json")
+	fs, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app, err := fs.GetAppInfo("wx_missing"); err != nil || app != nil {
+		t.Fatalf("need nil app, got: %+v, %v", app, err)
+	}
+	if err = fs.SaveAppInfo("wx_app", &open_platform.AuthorizerInfo{NickName: "nick"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Set("forever", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Set("expire", []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开文件, 数据不会丢失
+	fs, err = NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app, err := fs.GetAppInfo("wx_app"); err != nil || app == nil || app.NickName != "nick" {
+		t.Errorf("unexpected app: %+v, %v", app, err)
+	}
+	runAt(time.Now().Add(time.Hour), func() {
+		if value, err := fs.Get("forever"); err != nil || string(value) != "value" {
+			t.Errorf("need value, got: %q, %v", value, err)
+		}
+		if value, err := fs.Get("expire"); err != nil || value != nil {
+			t.Errorf("need expired, got: %q, %v", value, err)
+		}
+	})
+}
+
+func TestMemoryStorageExpiration(t *testing.T) {
+	m := NewMemoryStorage()
+	if err := m.Set("key", []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := m.Get("key"); string(value) != "value" {
+		t.Errorf("need value, got: %q", value)
+	}
+	runAt(time.Now().Add(time.Hour), func() {
+		if value, _ := m.Get("key"); value != nil {
+			t.Errorf("need expired, got: %q", value)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package src
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 分布式锁接口, 多实例部署时用于保证同一时间只有一个实例刷新 token, 可基于 redis SET NX 等实现
+type Locker interface {
+	// 尝试获得锁, 获得成功返回 true, 锁在 expiration 之后自动释放. value 用于标识锁的持有者
+	TryLock(key, value string, expiration time.Duration) (ok bool, err error)
+	// 释放锁, 只有 value 与加锁时一致才会释放
+	Unlock(key, value string) error
+}
+
+var (
+	tokenLockExpiration    = 10 * time.Second       // token 刷新锁的过期时间
+	tokenLockRetryInterval = 100 * time.Millisecond // 等待其他实例刷新 token 的检查间隔
+)
+
+// 在分布式锁的保护下刷新 token. load 用于读取已保存的 token, 返回 token 是否有效, 获得锁之后将再次检查
+// token, 防止重复刷新. 未获得锁时等待持有锁的实例刷新完成, locker 为 nil 时直接刷新
+func lockedRefresh(locker Locker, key string, load func() (token string, valid bool, err error), refresh func() (string, error)) (string, error) {
+	if locker == nil {
+		return refresh()
+	}
+	value, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	deadline := Now().Add(tokenLockExpiration)
+	for {
+		ok, err := locker.TryLock(key, value, tokenLockExpiration)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			defer func() {
+				_ = locker.Unlock(key, value)
+			}()
+			token, valid, err := load()
+			if err != nil {
+				return "", err
+			}
+			if valid {
+				return token, nil
+			}
+			return refresh()
+		}
+		time.Sleep(tokenLockRetryInterval)
+		token, valid, err := load()
+		if err != nil {
+			return "", err
+		}
+		if valid {
+			return token, nil
+		}
+		if Now().After(deadline) {
+			return "", fmt.Errorf("wait for %s timeout", key)
+		}
+	}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// 进程内的请求合并, 同一个 key 同一时间只执行一次, 其他调用者等待并共享执行结果
+type flightGroup struct {
+	calls map[string]*flightCall
+	mu    sync.Mutex
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val string
+	err error
+}
+
+func (g *flightGroup) do(key string, fn func() (string, error)) (string, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err
+}
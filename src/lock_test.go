@@ -0,0 +1,67 @@
+package src
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockedRefresh(t *testing.T) {
+	storage := NewMemoryStorage()
+	var refreshed int32
+	load := func() (string, bool, error) {
+		data, err := storage.Get("token")
+		return string(data), len(data) > 0, err
+	}
+	refresh := func() (string, error) {
+		atomic.AddInt32(&refreshed, 1)
+		time.Sleep(50 * time.Millisecond)
+		return "new_token", storage.Set("token", []byte("new_token"), time.Minute)
+	}
+	// 模拟多个实例, 每个实例拥有独立的 flightGroup, 共享同一个锁
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g := &flightGroup{}
+			token, err := g.do("token", func() (string, error) {
+				return lockedRefresh(storage, "token_lock", load, refresh)
+			})
+			if err != nil {
+				t.Error(err)
+			} else if token != "new_token" {
+				t.Errorf("need: new_token, got: %s", token)
+			}
+		}()
+	}
+	wg.Wait()
+	if refreshed != 1 {
+		t.Errorf("need refresh once, got: %d", refreshed)
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	g := &flightGroup{}
+	var calls int32
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, _ = g.do("key", func() (string, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(50 * time.Millisecond)
+				return "value", nil
+			})
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("need call once, got: %d", calls)
+	}
+}
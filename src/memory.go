@@ -0,0 +1,159 @@
+package src
+
+import (
+	"encoding/json"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 内存存储器, 支持过期时间, 同时实现了 AccessStorage, AppStorage 及 Locker 接口, 适用于单实例部署及测试
+type MemoryStorage struct {
+	values map[string]*memoryValue
+	apps   map[string][]byte // 公众号信息, 以 json 保存, 防止调用者修改已保存的数据
+	setNum int
+	mu     sync.Mutex
+}
+
+type memoryValue struct {
+	data      []byte
+	expiredAt time.Time // 为零值时永不过期
+}
+
+func (v *memoryValue) expired(now time.Time) bool {
+	return !v.expiredAt.IsZero() && !now.Before(v.expiredAt)
+}
+
+// 创建内存存储器
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		values: map[string]*memoryValue{},
+		apps:   map[string][]byte{},
+	}
+}
+
+// 保存数据, expiration 为 0 时永不过期, 小于 0 时表示数据已过期, 将删除已存在的数据
+func (m *MemoryStorage) Set(key string, value []byte, expiration time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if expiration < 0 {
+		delete(m.values, key)
+		return nil
+	}
+	now := Now()
+	v := &memoryValue{data: append([]byte(nil), value...)}
+	if expiration > 0 {
+		v.expiredAt = now.Add(expiration)
+	}
+	m.values[key] = v
+	// 每写入一定次数清理一次过期数据, 防止内存无限增长
+	m.setNum++
+	if m.setNum >= 1000 {
+		m.setNum = 0
+		for k, v := range m.values {
+			if v.expired(now) {
+				delete(m.values, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) Get(key string) (value []byte, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[key]
+	if !ok {
+		return nil, nil
+	}
+	if v.expired(Now()) {
+		delete(m.values, key)
+		return nil, nil
+	}
+	return append([]byte(nil), v.data...), nil
+}
+
+// 获得锁, 与 redis SET NX 语义一致
+func (m *MemoryStorage) TryLock(key, value string, expiration time.Duration) (ok bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := Now()
+	if v, ok := m.values[key]; ok && !v.expired(now) {
+		return false, nil
+	}
+	v := &memoryValue{data: []byte(value)}
+	if expiration > 0 {
+		v.expiredAt = now.Add(expiration)
+	}
+	m.values[key] = v
+	return true, nil
+}
+
+func (m *MemoryStorage) Unlock(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.values[key]; ok && string(v.data) == value {
+		delete(m.values, key)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) SaveAppInfo(appid string, app *open_platform.AuthorizerInfo) error {
+	data, err := json.Marshal(app)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apps[appid] = data
+	return nil
+}
+
+func (m *MemoryStorage) GetAppInfo(appid string) (*open_platform.AuthorizerInfo, error) {
+	m.mu.Lock()
+	data, ok := m.apps[appid]
+	m.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	app := &open_platform.AuthorizerInfo{}
+	err := json.Unmarshal(data, app)
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+func (m *MemoryStorage) DelAppInfo(appid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.apps, appid)
+	return nil
+}
+
+func (m *MemoryStorage) DelAppInfoNotIn(appids []string) error {
+	keep := make(map[string]bool, len(appids))
+	for _, appid := range appids {
+		keep[appid] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for appid := range m.apps {
+		if !keep[appid] {
+			delete(m.apps, appid)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) GetAppids() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	appids := make([]string, 0, len(m.apps))
+	for appid := range m.apps {
+		appids = append(appids, appid)
+	}
+	sort.Strings(appids)
+	return appids, nil
+}
@@ -0,0 +1,300 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 公众号迁移配置
+type MigrateOptions struct {
+	Concurrency int  // 最大并发数, 为 0 时默认 10
+	DryRun      bool // 只统计待迁移的公众号及将被删除的公众号, 不写入存储
+
+	// 断点存储器, 已迁移的公众号将被记录, 迁移中断后再次执行时跳过已迁移的公众号, 全部迁移成功且删除多余的公众号之后清除记录.
+	// 为 nil 时每次都迁移所有公众号
+	Checkpoint AccessStorage
+
+	// 断点最长保留时间(从断点所属的迁移开始时计算), 超过该时间的断点将被忽略, 重新迁移所有公众号.
+	// 为 0 时使用 DefaultMigrateCheckpointMaxAge, 小于 0 则不限制
+	CheckpointMaxAge time.Duration
+
+	// 忽略已有的断点, 重新迁移所有公众号
+	Fresh bool
+
+	// 每个公众号迁移完成(成功或失败)之后调用, 调用是串行的
+	OnProgress func(progress *MigrateProgress)
+}
+
+// 迁移进度
+type MigrateProgress struct {
+	Appid string // 当前完成的公众号
+	Err   error  // 当前公众号迁移错误
+	Done  int    // 本次已完成数量
+	Total int    // 本次需要迁移的数量, 不包含断点续传跳过的公众号
+}
+
+// 迁移报告
+type MigrateReport struct {
+	RunID      string // 迁移 id, 断点续传时与中断的迁移相同
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Total      int              // 已授权的公众号数量
+	Skipped    int              // 断点续传跳过的公众号数量
+	Migrated   int              // 本次迁移成功的数量, DryRun 时为待迁移的数量
+	Errors     map[string]error // 迁移失败的公众号, 再次执行时将重新迁移
+	// 已删除的公众号(已取消授权), DryRun 时为将被删除的公众号. 仅在 AppStorage 实现了 AppidLister 时列出
+	Deleted []string
+}
+
+// 每完成多少个公众号保存一次断点
+const migrateCheckpointEvery = 50
+
+// 默认断点最长保留时间
+const DefaultMigrateCheckpointMaxAge = 24 * time.Hour
+
+// 迁移公众号, 获得已授权公众号信息以及 refresh token, 并删除多余的公众号(可能公众号已解除授权)
+func (oc *OpenClient) MigrateApps() error {
+	report, err := oc.MigrateAppsWithOptions(nil)
+	if err != nil {
+		return err
+	}
+	if len(report.Errors) > 0 {
+		failed := make([]string, 0, len(report.Errors))
+		for appid, err := range report.Errors {
+			failed = append(failed, appid+": "+err.Error())
+		}
+		sort.Strings(failed)
+		return fmt.Errorf("failed to migrate %d apps: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// 并发迁移公众号, 单个公众号迁移失败不会中断迁移, 错误记录在报告中.
+// 拉取授权列表失败时返回错误且不会删除任何公众号
+func (oc *OpenClient) MigrateAppsWithOptions(opts *MigrateOptions) (*MigrateReport, error) {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 10
+	}
+	if opts.CheckpointMaxAge == 0 {
+		opts.CheckpointMaxAge = DefaultMigrateCheckpointMaxAge
+	}
+	report := &MigrateReport{StartedAt: Now(), Errors: map[string]error{}}
+	authorizers, err := oc.getAuthorizers()
+	if err != nil {
+		return nil, err
+	}
+	report.Total = len(authorizers)
+	appids := make([]string, 0, len(authorizers))
+	for _, information := range authorizers {
+		appids = append(appids, information.AuthorizerAppid)
+	}
+	report.Deleted, err = oc.appidsNotIn(appids)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &migrateCheckpoint{storage: opts.Checkpoint, key: oc.configs.Appid + "_migrate_checkpoint"}
+	if !opts.Fresh {
+		err = checkpoint.load(opts.CheckpointMaxAge)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if checkpoint.RunID == "" {
+		checkpoint.RunID = strconv.FormatInt(report.StartedAt.UnixNano(), 36)
+		checkpoint.StartedAt = report.StartedAt.Unix()
+	}
+	report.RunID = checkpoint.RunID
+	done := map[string]bool{}
+	for _, appid := range checkpoint.Appids {
+		done[appid] = true
+	}
+	var pending []*open_platform.AuthorizerInformation
+	for _, information := range authorizers {
+		if done[information.AuthorizerAppid] {
+			report.Skipped++
+		} else {
+			pending = append(pending, information)
+		}
+	}
+	if opts.DryRun {
+		report.Migrated = len(pending)
+		report.FinishedAt = Now()
+		return report, nil
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var checkpointErr error
+	sem := make(chan struct{}, opts.Concurrency)
+	for _, information := range pending {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(information *open_platform.AuthorizerInformation) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			appid := information.AuthorizerAppid
+			err := oc.migrateApp(information)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				report.Errors[appid] = err
+			} else {
+				report.Migrated++
+				done[appid] = true
+				if report.Migrated%migrateCheckpointEvery == 0 && checkpointErr == nil {
+					checkpointErr = checkpoint.save(done)
+				}
+			}
+			if opts.OnProgress != nil {
+				opts.OnProgress(&MigrateProgress{
+					Appid: appid,
+					Err:   err,
+					Done:  report.Migrated + len(report.Errors),
+					Total: len(pending),
+				})
+			}
+		}(information)
+	}
+	wg.Wait()
+	if checkpointErr != nil {
+		return nil, checkpointErr
+	}
+	err = checkpoint.save(done)
+	if err != nil {
+		return nil, err
+	}
+	err = oc.configs.AppStorage.DelAppInfoNotIn(appids)
+	if err != nil {
+		return nil, err
+	}
+	// 删除成功之后才清除断点, 删除失败时再次执行可跳过已迁移的公众号
+	if len(report.Errors) == 0 {
+		err = checkpoint.clear()
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.FinishedAt = Now()
+	return report, nil
+}
+
+// 保存 refresh token 并获取授权方信息
+func (oc *OpenClient) migrateApp(information *open_platform.AuthorizerInformation) error {
+	token := &AppAccessToken{
+		RefreshToken: information.RefreshToken,
+	}
+	err := oc.configs.ComponentStorage.SaveAppAccessToken(information.AuthorizerAppid, token)
+	if err != nil {
+		return err
+	}
+	_, err = oc.refreshAppInfo(information.AuthorizerAppid)
+	return err
+}
+
+// 拉取所有已授权的公众号
+func (oc *OpenClient) getAuthorizers() ([]*open_platform.AuthorizerInformation, error) {
+	accessToken, err := oc.getComponentAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	var authorizers []*open_platform.AuthorizerInformation
+	var offset, limit = 0, 500
+	for {
+		list, err := open_platform.GetAuthorizerList(accessToken, oc.configs.Appid, offset, limit)
+		if err != nil {
+			return nil, err
+		}
+		authorizers = append(authorizers, list.List...)
+		if len(list.List) < limit {
+			return authorizers, nil
+		}
+		offset += limit
+	}
+}
+
+// 获得已保存但不存在于 appids 中的公众号, AppStorage 未实现 AppidLister 时返回 nil
+func (oc *OpenClient) appidsNotIn(appids []string) ([]string, error) {
+	lister, ok := oc.configs.AppStorage.(AppidLister)
+	if !ok {
+		return nil, nil
+	}
+	saved, err := lister.GetAppids()
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool, len(appids))
+	for _, appid := range appids {
+		keep[appid] = true
+	}
+	var dels []string
+	for _, appid := range saved {
+		if !keep[appid] {
+			dels = append(dels, appid)
+		}
+	}
+	sort.Strings(dels)
+	return dels, nil
+}
+
+// 迁移断点, 记录已迁移的公众号及所属的迁移
+type migrateCheckpoint struct {
+	storage   AccessStorage
+	key       string
+	RunID     string   `json:"run_id"`
+	StartedAt int64    `json:"started_at"` // 迁移开始时间, unix 时间戳
+	Appids    []string `json:"appids"`
+}
+
+// 读取断点, 超过 maxAge 的断点将被忽略
+func (c *migrateCheckpoint) load(maxAge time.Duration) error {
+	if c.storage == nil {
+		return nil
+	}
+	data, err := c.storage.Get(c.key)
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return err
+	}
+	if maxAge > 0 && time.Unix(c.StartedAt, 0).Add(maxAge).Before(Now()) {
+		c.RunID, c.StartedAt, c.Appids = "", 0, nil
+	}
+	return nil
+}
+
+func (c *migrateCheckpoint) save(done map[string]bool) error {
+	if c.storage == nil {
+		return nil
+	}
+	c.Appids = make([]string, 0, len(done))
+	for appid := range done {
+		c.Appids = append(c.Appids, appid)
+	}
+	sort.Strings(c.Appids)
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return c.storage.Set(c.key, data, 0)
+}
+
+func (c *migrateCheckpoint) clear() error {
+	if c.storage == nil {
+		return nil
+	}
+	return c.storage.Set(c.key, nil, 0)
+}
@@ -0,0 +1,153 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 模拟开放平台接口, fail 不为 0 时获取 wx_fail 的授权方信息失败
+func mockOpenPlatform(t *testing.T, appids []string, fail *int32) {
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		data := map[string]string{}
+		_ = json.Unmarshal(body, &data)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/api_get_authorizer_list"):
+			return authorizerListResponse(appids, body)
+		case strings.HasSuffix(r.URL.Path, "/api_get_authorizer_info"):
+			appid := data["authorizer_appid"]
+			if appid == "wx_fail" && atomic.LoadInt32(fail) != 0 {
+				return map[string]interface{}{"errcode": 61003, "errmsg": "component is not authorized by this account"}
+			}
+			return map[string]interface{}{
+				"authorizer_info":    map[string]interface{}{"nick_name": "nick_" + appid},
+				"authorization_info": map[string]interface{}{"authorizer_appid": appid},
+			}
+		}
+		return map[string]interface{}{"errcode": 40001, "errmsg": "unexpected request"}
+	})
+}
+
+func TestMigrateApps(t *testing.T) {
+	fail := int32(1)
+	mockOpenPlatform(t, []string{"wx_a", "wx_b", "wx_fail"}, &fail)
+	storage := NewMemoryStorage()
+	oc := newTestOpenClient(t, &OpenClientConfigs{AppStorage: storage})
+	// token 在断点过期之后仍有效
+	err := oc.configs.ComponentStorage.SaveAccessToken(&ExpireData{Value: "token", ExpiredAt: Now().Add(2 * DefaultMigrateCheckpointMaxAge).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = storage.SaveAppInfo("wx_old", &open_platform.AuthorizerInfo{NickName: "old"})
+
+	// 只列出将被删除的公众号, 不写入存储
+	report, err := oc.MigrateAppsWithOptions(&MigrateOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonStr(report.Deleted) != `["wx_old"]` || report.Migrated != 3 || report.Total != 3 {
+		t.Errorf("unexpected dry run report: %s", jsonStr(report))
+	}
+	if appids, _ := storage.GetAppids(); jsonStr(appids) != `["wx_old"]` {
+		t.Errorf("dry run should not write storage, got: %v", appids)
+	}
+
+	// 单个公众号失败不会中断迁移
+	checkpoint := NewMemoryStorage()
+	var progresses []*MigrateProgress
+	report, err = oc.MigrateAppsWithOptions(&MigrateOptions{
+		Concurrency: 2,
+		Checkpoint:  checkpoint,
+		OnProgress: func(progress *MigrateProgress) {
+			progresses = append(progresses, progress)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 2 || len(report.Errors) != 1 || report.Errors["wx_fail"] == nil {
+		t.Errorf("unexpected report: %s", jsonStr(report))
+	}
+	if len(progresses) != 3 || progresses[2].Done != 3 || progresses[2].Total != 3 {
+		t.Errorf("unexpected progresses: %s", jsonStr(progresses))
+	}
+	if appids, _ := storage.GetAppids(); jsonStr(appids) != `["wx_a","wx_b"]` {
+		t.Errorf("unexpected apps: %v", appids)
+	}
+	if token, _ := oc.configs.ComponentStorage.GetAppAccessToken("wx_a"); token == nil || token.RefreshToken != "refresh_wx_a" {
+		t.Errorf("unexpected token: %+v", token)
+	}
+
+	runID := report.RunID
+
+	// 忽略过期的断点或指定重新迁移时不跳过
+	runAt(Now().Add(DefaultMigrateCheckpointMaxAge+time.Minute), func() {
+		report, err = oc.MigrateAppsWithOptions(&MigrateOptions{DryRun: true, Checkpoint: checkpoint})
+	})
+	if err != nil || report.Skipped != 0 || report.RunID == runID {
+		t.Errorf("expired checkpoint should be ignored: %s, %v", jsonStr(report), err)
+	}
+	report, err = oc.MigrateAppsWithOptions(&MigrateOptions{DryRun: true, Checkpoint: checkpoint, Fresh: true})
+	if err != nil || report.Skipped != 0 || report.RunID == runID {
+		t.Errorf("fresh run should not skip: %s, %v", jsonStr(report), err)
+	}
+
+	// 再次执行时跳过已迁移的公众号
+	atomic.StoreInt32(&fail, 0)
+	report, err = oc.MigrateAppsWithOptions(&MigrateOptions{Checkpoint: checkpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 2 || report.Migrated != 1 || len(report.Errors) != 0 || report.RunID != runID {
+		t.Errorf("unexpected report: %s", jsonStr(report))
+	}
+	if data, _ := checkpoint.Get("component_migrate_checkpoint"); len(data) != 0 {
+		t.Errorf("checkpoint should be cleared, got: %s", data)
+	}
+	if app, _ := storage.GetAppInfo("wx_fail"); app == nil || app.NickName != "nick_wx_fail" {
+		t.Errorf("unexpected app: %+v", app)
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	if err = oc.MigrateApps(); err == nil || !strings.Contains(err.Error(), "failed to migrate 1 apps: wx_fail: ") {
+		t.Errorf("need wx_fail error, got: %v", err)
+	}
+}
+
+// 删除公众号失败的存储器
+type failDeleteAppStorage struct {
+	*MemoryStorage
+}
+
+func (failDeleteAppStorage) DelAppInfoNotIn(appids []string) error {
+	return errors.New("delete failed")
+}
+
+func TestMigrateAppsDeleteFailed(t *testing.T) {
+	var fail int32
+	mockOpenPlatform(t, []string{"wx_a"}, &fail)
+	storage := NewMemoryStorage()
+	oc := newTestOpenClient(t, &OpenClientConfigs{AppStorage: failDeleteAppStorage{storage}})
+	err := oc.configs.ComponentStorage.SaveAccessToken(&ExpireData{Value: "token", ExpiredAt: Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := NewMemoryStorage()
+	if _, err = oc.MigrateAppsWithOptions(&MigrateOptions{Checkpoint: checkpoint}); err == nil {
+		t.Fatal("need delete error")
+	}
+	// 删除失败时保留断点, 再次执行时跳过已迁移的公众号
+	oc.configs.AppStorage = storage
+	report, err := oc.MigrateAppsWithOptions(&MigrateOptions{Checkpoint: checkpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 1 || report.Migrated != 0 {
+		t.Errorf("unexpected report: %s", jsonStr(report))
+	}
+}
@@ -1,22 +1,35 @@
 package src
 
 import (
+	"errors"
 	"fmt"
 	"github.com/morgine/wechat_sdk/pkg"
 	"github.com/morgine/wechat_sdk/pkg/open_platform"
 	"log"
 	"net/http"
+	"os"
 	"sync"
+	"time"
 )
 
 type OpenClient struct {
-	configs       *OpenClientConfigs
-	publicClients map[string]*PublicClient
-	msgCrypt      *pkg.WXBizMsgCrypt
-	*Dispatcher
-	mu sync.Mutex
+	configs        *OpenClientConfigs
+	clients        *shardedClientCache
+	clientFlights  clientFlightGroup      // 公众号客户端加载请求合并
+	clientGens     map[string]uint64      // 正在加载的公众号客户端代数, 移除或更新客户端时递增, 之前开始的加载结果将被丢弃
+	waitTags       *tagWaitList           // 各公众号客户端共用的等待打标签用户
+	dispatchers    map[string]*Dispatcher // 运行时为公众号单独设置的事件处理器
+	msgCrypt       *pkg.WXBizMsgCrypt
+	*Dispatcher    // 默认事件处理器
+	notifyHandlers map[open_platform.ComponentAuthorizationEvent][]AuthorizationHandler
+	nmu            sync.RWMutex // 保护 notifyHandlers
+	flights        flightGroup  // token 刷新请求合并
+	mu             sync.Mutex
 }
 
+// 事件处理器解析器, 根据公众号 appid 获得事件处理器, 返回 nil 则使用默认事件处理器
+type DispatcherResolver func(appid string) *Dispatcher
+
 type OpenClientConfigs struct {
 	Appid            string
 	Secret           string
@@ -25,7 +38,26 @@ type OpenClientConfigs struct {
 	AesToken         string           // 消息加解密 token
 	ComponentStorage ComponentStorage // 开放平台存储器
 	AppStorage       AppStorage       // 公众号信息存储器
-	Logger           *log.Logger      // 错误日志收集器
+	Logger           *log.Logger      // 错误日志收集器, 为 nil 时输出到标准错误
+	Locker           Locker           // 分布式锁, 多实例部署时保证同一时间只有一个实例刷新 token, 为 nil 时只在进程内合并刷新请求
+	DedupStorage     AccessStorage    // 消息去重存储器, 为 nil 时所有公众号共用同一内存存储器
+	SessionStorage   SessionStorage   // 用户会话存储器, 为 nil 时所有公众号共用同一内存存储器
+
+	// 事件处理器解析器, 用于为不同公众号提供不同的回复逻辑, 为 nil 时所有公众号使用默认事件处理器.
+	// 解析器在持有 OpenClient 锁时调用, 不可在解析器中调用 OpenClient 的方法
+	DispatcherResolver DispatcherResolver
+
+	// 公众号客户端缓存, 超过 ClientCacheSize 时淘汰最久未使用的客户端, 为 0 时使用 DefaultClientCacheSize, 小于 0 则不限制.
+	// 客户端缓存 ClientCacheTTL 后重新读取公众号信息, 不存在的公众号缓存 NegativeCacheTTL, 为 0 时使用默认值
+	ClientCacheSize  int
+	ClientCacheTTL   time.Duration
+	NegativeCacheTTL time.Duration
+
+	// 调用公众号接口前检查权限集, 见 PublicClientConfigs.CheckScope
+	CheckScope bool
+
+	// 开启全网发布检测自动应答, 检测帐号(见 ReleaseTestAppids)的消息将由 SDK 自动处理, 不会触发事件处理器
+	ReleaseTest bool
 }
 
 func NewOpenClient(configs *OpenClientConfigs) (*OpenClient, error) {
@@ -33,12 +65,34 @@ func NewOpenClient(configs *OpenClientConfigs) (*OpenClient, error) {
 	if err != nil {
 		return nil, err
 	}
+	if configs.ClientCacheSize == 0 {
+		configs.ClientCacheSize = DefaultClientCacheSize
+	}
+	if configs.ClientCacheTTL == 0 {
+		configs.ClientCacheTTL = DefaultClientCacheTTL
+	}
+	if configs.NegativeCacheTTL == 0 {
+		configs.NegativeCacheTTL = DefaultNegativeCacheTTL
+	}
+	if configs.Logger == nil {
+		configs.Logger = log.New(os.Stderr, configs.Appid, log.LstdFlags|log.Llongfile)
+	}
+	// 默认存储器由所有客户端共用, 客户端被缓存淘汰后重新创建时不会丢失数据
+	if configs.DedupStorage == nil {
+		configs.DedupStorage = NewMemoryStorage()
+	}
+	if configs.SessionStorage == nil {
+		configs.SessionStorage = NewSessionStorage(NewMemoryStorage())
+	}
 	return &OpenClient{
-		configs:       configs,
-		publicClients: map[string]*PublicClient{},
-		msgCrypt:      msgCrypt,
-		Dispatcher:    NewDispatcher(),
-		mu:            sync.Mutex{},
+		configs:        configs,
+		clients:        newShardedClientCache(clientCacheShards, configs.ClientCacheSize, configs.ClientCacheTTL, configs.NegativeCacheTTL),
+		dispatchers:    map[string]*Dispatcher{},
+		waitTags:       newTagWaitList(),
+		notifyHandlers: map[open_platform.ComponentAuthorizationEvent][]AuthorizationHandler{},
+		msgCrypt:       msgCrypt,
+		Dispatcher:     NewDispatcher(),
+		mu:             sync.Mutex{},
 	}, nil
 }
 
@@ -46,6 +100,34 @@ func (oc *OpenClient) Configs() *OpenClientConfigs {
 	return oc.configs
 }
 
+// 为公众号设置事件处理器, 可在运行时调用, 已创建的客户端将立即使用新的处理器.
+// d 为 nil 时恢复为解析器或默认事件处理器
+func (oc *OpenClient) SetAppDispatcher(appid string, d *Dispatcher) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if d == nil {
+		delete(oc.dispatchers, appid)
+	} else {
+		oc.dispatchers[appid] = d
+	}
+	if client := oc.clients.peek(appid); client != nil {
+		client.SetDispatcher(oc.getDispatcher(appid))
+	}
+}
+
+// 获得公众号事件处理器, 优先级: 运行时设置的处理器 > 解析器 > 默认处理器. 调用者需持有锁
+func (oc *OpenClient) getDispatcher(appid string) *Dispatcher {
+	if d, ok := oc.dispatchers[appid]; ok {
+		return d
+	}
+	if oc.configs.DispatcherResolver != nil {
+		if d := oc.configs.DispatcherResolver(appid); d != nil {
+			return d
+		}
+	}
+	return oc.Dispatcher
+}
+
 // 监听通知消息
 func (oc *OpenClient) ListenVerifyTicket(w http.ResponseWriter, r *http.Request) {
 	notify, err := open_platform.ListenComponentAuthorizationNotify(r, oc.msgCrypt)
@@ -61,99 +143,272 @@ func (oc *OpenClient) ListenVerifyTicket(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// 授权变更在所有处理器执行成功之后才保存, 处理器返回错误时微信服务器重新推送的通知将得到相同的事件
 func (oc *OpenClient) setNotify(notify *open_platform.AuthorizationNotify) error {
+	evt := &AuthorizationEvent{Notify: notify}
+	var apply func() error
 	switch notify.InfoType {
 	case open_platform.EvtComponentVerifyTicket:
-		return oc.configs.ComponentStorage.SaveVerifyTicket(notify.ComponentVerifyTicket)
+		err := oc.configs.ComponentStorage.SaveVerifyTicket(notify.ComponentVerifyTicket)
+		if err != nil {
+			return err
+		}
 	case open_platform.EvtAuthorized, open_platform.EvtUpdateAuthorized:
-		_, err := oc.refreshAppInfo(notify.AuthorizerAppid)
+		old, err := oc.configs.AppStorage.GetAppInfo(notify.AuthorizerAppid)
 		if err != nil {
 			return err
 		}
+		evt.Info, err = oc.fetchAppInfo(notify.AuthorizerAppid)
+		if err != nil {
+			return err
+		}
+		evt.Granted, evt.Revoked = diffFuncScopes(old, evt.Info)
+		apply = func() error {
+			return oc.saveAppInfo(notify.AuthorizerAppid, evt.Info)
+		}
 	case open_platform.EvtUnauthorized:
-		oc.mu.Lock()
-		defer oc.mu.Unlock()
-		delete(oc.publicClients, notify.AuthorizerAppid)
-		return oc.configs.AppStorage.DelAppInfo(notify.AuthorizerAppid)
+		info, err := oc.configs.AppStorage.GetAppInfo(notify.AuthorizerAppid)
+		if err != nil {
+			return err
+		}
+		evt.Info = info
+		apply = func() error {
+			// 先删除存储再移除缓存, 避免并发的加载请求读取到旧数据后重新缓存
+			err := oc.configs.AppStorage.DelAppInfo(notify.AuthorizerAppid)
+			if err != nil {
+				return err
+			}
+			oc.removeClient(notify.AuthorizerAppid)
+			return nil
+		}
 	default:
 		return nil
 	}
+	oc.nmu.RLock()
+	handlers := oc.notifyHandlers[notify.InfoType]
+	oc.nmu.RUnlock()
+	for _, h := range handlers {
+		err := h(evt)
+		if err != nil {
+			return err
+		}
+	}
+	if apply != nil {
+		return apply()
+	}
 	return nil
 }
 
+// 授权事件
+type AuthorizationEvent struct {
+	Notify *open_platform.AuthorizationNotify // 授权通知
+	// 授权方信息, 授权及更新授权事件为拉取的最新信息, 取消授权事件为已保存的信息(可能为 nil),
+	// component_verify_ticket 事件为 nil
+	Info    *open_platform.AuthorizerInfo
+	Granted []int // 新增的权限集 id, 授权事件为所有权限集
+	Revoked []int // 被取消的权限集 id, 仅更新授权事件可能存在
+}
+
+// 授权事件处理器, 处理器执行时授权变更尚未保存(公众号信息未更新或未删除).
+// 返回错误时不保存授权变更且不响应 success, 微信服务器将重新推送该通知, 已执行成功的处理器将再次执行, 处理器应是幂等的
+type AuthorizationHandler func(evt *AuthorizationEvent) error
+
+// 添加授权成功事件处理器
+func (oc *OpenClient) OnAuthorized(h AuthorizationHandler) {
+	oc.onNotify(open_platform.EvtAuthorized, h)
+}
+
+// 添加更新授权事件处理器
+func (oc *OpenClient) OnUpdateAuthorized(h AuthorizationHandler) {
+	oc.onNotify(open_platform.EvtUpdateAuthorized, h)
+}
+
+// 添加取消授权事件处理器
+func (oc *OpenClient) OnUnauthorized(h AuthorizationHandler) {
+	oc.onNotify(open_platform.EvtUnauthorized, h)
+}
+
+// 添加 component_verify_ticket 推送事件处理器, 处理器在 ticket 保存之后调用
+func (oc *OpenClient) OnVerifyTicket(h AuthorizationHandler) {
+	oc.onNotify(open_platform.EvtComponentVerifyTicket, h)
+}
+
+// 添加授权事件处理器, 可在监听过程中添加
+func (oc *OpenClient) onNotify(evt open_platform.ComponentAuthorizationEvent, h AuthorizationHandler) {
+	oc.nmu.Lock()
+	defer oc.nmu.Unlock()
+	handlers := oc.notifyHandlers[evt]
+	// 复制切片, 避免与正在执行的处理器共用底层数组
+	oc.notifyHandlers[evt] = append(handlers[:len(handlers):len(handlers)], h)
+}
+
+// 比较授权前后的权限集, 获得新增及被取消的权限集 id
+func diffFuncScopes(old, new *open_platform.AuthorizerInfo) (granted, revoked []int) {
+	var oldIDs, newIDs = map[int]bool{}, map[int]bool{}
+	if old != nil {
+		for _, scope := range old.FuncInfo {
+			oldIDs[scope.FuncscopeCategory.ID] = true
+		}
+	}
+	if new != nil {
+		for _, scope := range new.FuncInfo {
+			id := scope.FuncscopeCategory.ID
+			newIDs[id] = true
+			if !oldIDs[id] {
+				granted = append(granted, id)
+			}
+		}
+	}
+	if old != nil {
+		for _, scope := range old.FuncInfo {
+			if id := scope.FuncscopeCategory.ID; !newIDs[id] {
+				revoked = append(revoked, id)
+			}
+		}
+	}
+	return granted, revoked
+}
+
 // 获得三方平台 access token
 func (oc *OpenClient) getComponentAccessToken() (string, error) {
-	token, err := oc.configs.ComponentStorage.GetAccessToken()
+	return oc.getComponentAccessTokenBefore(0)
+}
+
+// 获得三方平台 access token, 如果 token 将在 ahead 时间内过期, 则提前刷新
+func (oc *OpenClient) getComponentAccessTokenBefore(ahead time.Duration) (string, error) {
+	load := func() (string, bool, error) {
+		return oc.loadComponentAccessToken(Now().Add(ahead).Unix())
+	}
+	token, valid, err := load()
+	if err != nil {
+		return "", err
+	}
+	if valid {
+		return token, nil
+	}
+	return oc.flights.do("component_access_token", func() (string, error) {
+		return lockedRefresh(oc.configs.Locker, oc.configs.Appid+"_component_access_token_lock", load, oc.refreshComponentAccessToken)
+	})
+}
+
+// 读取已保存的三方平台 access token, token 在 at 时间之前未过期才有效
+func (oc *OpenClient) loadComponentAccessToken(at int64) (token string, valid bool, err error) {
+	data, err := oc.configs.ComponentStorage.GetAccessToken()
+	if err != nil {
+		return "", false, err
+	}
+	if data == nil || data.ExpiredAt < at {
+		return "", false, nil
+	}
+	return data.Value, true, nil
+}
+
+// 刷新并保存三方平台 access token
+func (oc *OpenClient) refreshComponentAccessToken() (string, error) {
+	verifyTicket, err := oc.configs.ComponentStorage.GetVerifyTicket()
 	if err != nil {
 		return "", err
 	}
-	now := Now().Unix()
-	if token == nil || token.ExpiredAt < now {
-		verifyTicket, err := oc.configs.ComponentStorage.GetVerifyTicket()
+	if verifyTicket == "" {
+		return "", fmt.Errorf("component %s: verify ticket is empty", oc.configs.Appid)
+	}
+	accessToken, err := open_platform.GetComponentAccessToken(oc.configs.Appid, oc.configs.Secret, verifyTicket)
+	if err != nil {
+		return "", err
+	}
+	token := &ExpireData{
+		Value:     accessToken.Token,
+		ExpiredAt: Now().Unix() + accessToken.ExpiresIn - (accessToken.ExpiresIn >> 3), // 过期时间提前 1/8
+	}
+	err = oc.configs.ComponentStorage.SaveAccessToken(token)
+	if err != nil {
+		return "", err
+	}
+	return token.Value, nil
+}
+
+// 获得 pre auth code, ComponentStorage 实现了 PreAuthCodeStorage 时缓存至过期
+func (oc *OpenClient) getPreAuthCode() (string, error) {
+	storage, cacheable := oc.configs.ComponentStorage.(PreAuthCodeStorage)
+	if cacheable {
+		code, err := storage.GetPreAuthCode()
 		if err != nil {
 			return "", err
 		}
-		if verifyTicket == "" {
-			return "", fmt.Errorf("component %s: verify ticket is empty", oc.configs.Appid)
+		if code != nil && code.ExpiredAt > Now().Unix() {
+			return code.Value, nil
 		}
-		accessToken, err := open_platform.GetComponentAccessToken(oc.configs.Appid, oc.configs.Secret, verifyTicket)
+	}
+	return oc.flights.do("pre_auth_code", func() (string, error) {
+		token, err := oc.getComponentAccessToken()
 		if err != nil {
 			return "", err
 		}
-		token = &ExpireData{
-			Value:     accessToken.Token,
-			ExpiredAt: now + accessToken.ExpiresIn - (accessToken.ExpiresIn >> 3), // 过期时间提前 1/8
-		}
-		err = oc.configs.ComponentStorage.SaveAccessToken(token)
+		pac, err := open_platform.CreatePreAuthCode(oc.configs.Appid, token)
 		if err != nil {
 			return "", err
 		}
-	}
-	return token.Value, nil
+		if cacheable {
+			now := Now().Unix()
+			err = storage.SavePreAuthCode(&ExpireData{
+				Value:     pac.PreAuthCode,
+				ExpiredAt: now + pac.ExpiresIn - (pac.ExpiresIn >> 3), // 过期时间提前 1/8
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+		return pac.PreAuthCode, nil
+	})
 }
 
-// 获得 pre auth code
-func (oc *OpenClient) getPreAuthCode() (string, error) {
-	//code, err := oc.configs.ComponentStorage.GetPreAuthCode()
-	//if err != nil {
-	//	return "", err
-	//}
-	//now := Now().Unix()
-	//if code == nil || code.ExpiredAt < now {
-	token, err := oc.getComponentAccessToken()
-	if err != nil {
-		return "", nil
+// 授权地址选项
+type LoginPageOptions struct {
+	AuthType string // 要授权的帐号类型, 见 open_platform.AuthTypeOfficialAccount 等, 为空时公众号和小程序都展示
+	BizAppid string // 指定授权唯一的公众号或小程序, 与 AuthType 互斥
+}
+
+func (oc *OpenClient) loginPageOptions(redirect string, opts *LoginPageOptions) (*open_platform.ComponentLoginPageOptions, error) {
+	if opts == nil {
+		opts = &LoginPageOptions{}
+	}
+	if opts.AuthType != "" && opts.BizAppid != "" {
+		return nil, errors.New("AuthType and BizAppid cannot both be set")
 	}
-	pac, err := open_platform.CreatePreAuthCode(oc.configs.Appid, token)
+	preAuthCode, err := oc.getPreAuthCode()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return pac.PreAuthCode, nil
-	//code = &ExpireData{
-	//	Value:     pac.PreAuthCode,
-	//	ExpiredAt: now + pac.ExpiresIn - (pac.ExpiresIn >> 3), // 过期时间提前 1/8
-	//}
-	//err = oc.configs.ComponentStorage.SavePreAuthCode(code)
-	//if err != nil {
-	//	return "", err
-	//}
-	//}
-	//return code.Value, nil
+	return &open_platform.ComponentLoginPageOptions{
+		ComponentAppid: oc.configs.Appid,
+		PreAuthCode:    preAuthCode,
+		RedirectUri:    redirect,
+		AuthType:       opts.AuthType,
+		BizAppid:       opts.BizAppid,
+	}, nil
 }
 
 // 获得授权地址
 func (oc *OpenClient) ComponentLoginPage(redirect string) (string, error) {
-	preAuthCode, err := oc.getPreAuthCode()
+	return oc.ComponentLoginPageWithOptions(redirect, nil)
+}
+
+// 获得授权地址, 可限制授权的帐号类型或指定授权的帐号
+func (oc *OpenClient) ComponentLoginPageWithOptions(redirect string, opts *LoginPageOptions) (string, error) {
+	ao, err := oc.loginPageOptions(redirect, opts)
 	if err != nil {
 		return "", err
 	}
-	return open_platform.ComponentLoginPage(&open_platform.ComponentLoginPageOptions{
-		ComponentAppid: oc.configs.Appid,
-		PreAuthCode:    preAuthCode,
-		RedirectUri:    redirect,
-		AuthType:       "",
-		BizAppid:       "",
-	}), nil
+	return open_platform.ComponentLoginPage(ao), nil
+}
+
+// 获得移动端授权链接, 需在微信客户端中打开
+func (oc *OpenClient) ComponentBindPage(redirect string, opts *LoginPageOptions) (string, error) {
+	ao, err := oc.loginPageOptions(redirect, opts)
+	if err != nil {
+		return "", err
+	}
+	return open_platform.ComponentBindPage(ao), nil
 }
 
 // 获得授权信息, 用户授权/未授权都跳回该地址
@@ -183,39 +438,88 @@ func (oc *OpenClient) ListenLoginPage(request *http.Request) error {
 
 // 获得公众号 access token
 func (oc *OpenClient) getAppAccessToken(appid string) (string, error) {
+	return oc.getAppAccessTokenBefore(appid, 0)
+}
+
+// 获得公众号 access token, 如果 token 将在 ahead 时间内过期, 则提前刷新
+func (oc *OpenClient) getAppAccessTokenBefore(appid string, ahead time.Duration) (string, error) {
+	load := func() (string, bool, error) {
+		return oc.loadAppAccessToken(appid, Now().Add(ahead).Unix())
+	}
+	token, valid, err := load()
+	if err != nil {
+		return "", err
+	}
+	if valid {
+		return token, nil
+	}
+	refresh := func() (string, error) {
+		return oc.refreshAppAccessToken(appid)
+	}
+	return oc.flights.do("app_access_token_"+appid, func() (string, error) {
+		return lockedRefresh(oc.configs.Locker, oc.configs.Appid+"_app_access_token_lock_"+appid, load, refresh)
+	})
+}
+
+// 读取已保存的公众号 access token, token 在 at 时间之前未过期才有效
+func (oc *OpenClient) loadAppAccessToken(appid string, at int64) (token string, valid bool, err error) {
+	appAccessToken, err := oc.configs.ComponentStorage.GetAppAccessToken(appid)
+	if err != nil {
+		return "", false, err
+	}
+	if appAccessToken == nil {
+		return "", false, fmt.Errorf("%s unauthorized or access token missing", appid)
+	}
+	if appAccessToken.ExpireAt < at {
+		return "", false, nil
+	}
+	return appAccessToken.AccessToken, true, nil
+}
+
+// 使用 refresh token 刷新并保存公众号 access token
+func (oc *OpenClient) refreshAppAccessToken(appid string) (string, error) {
 	appAccessToken, err := oc.configs.ComponentStorage.GetAppAccessToken(appid)
 	if err != nil {
 		return "", err
 	}
 	if appAccessToken == nil {
 		return "", fmt.Errorf("%s unauthorized or access token missing", appid)
-	} else {
-		now := Now().Unix()
-		if appAccessToken.ExpireAt < now {
-			componentToken, err := oc.getComponentAccessToken()
-			if err != nil {
-				return "", err
-			}
-			authToken, err := open_platform.RefreshAuthorizerToken(oc.configs.Appid, appid, appAccessToken.RefreshToken, componentToken)
-			if err != nil {
-				return "", err
-			}
-			appAccessToken = &AppAccessToken{
-				AccessToken:  authToken.AuthorizerAccessToken,
-				ExpireAt:     Now().Unix() + authToken.ExpiresIn - (authToken.ExpiresIn >> 3),
-				RefreshToken: authToken.AuthorizerRefreshToken,
-			}
-			err = oc.configs.ComponentStorage.SaveAppAccessToken(appid, appAccessToken)
-			if err != nil {
-				return "", err
-			}
-		}
-		return appAccessToken.AccessToken, nil
 	}
+	componentToken, err := oc.getComponentAccessToken()
+	if err != nil {
+		return "", err
+	}
+	authToken, err := open_platform.RefreshAuthorizerToken(oc.configs.Appid, appid, appAccessToken.RefreshToken, componentToken)
+	if err != nil {
+		return "", err
+	}
+	appAccessToken = &AppAccessToken{
+		AccessToken:  authToken.AuthorizerAccessToken,
+		ExpireAt:     Now().Unix() + authToken.ExpiresIn - (authToken.ExpiresIn >> 3),
+		RefreshToken: authToken.AuthorizerRefreshToken,
+	}
+	err = oc.configs.ComponentStorage.SaveAppAccessToken(appid, appAccessToken)
+	if err != nil {
+		return "", err
+	}
+	return appAccessToken.AccessToken, nil
 }
 
 // 获取并保存公众号信息
 func (oc *OpenClient) refreshAppInfo(appid string) (*open_platform.AuthorizerInfo, error) {
+	info, err := oc.fetchAppInfo(appid)
+	if err != nil {
+		return nil, err
+	}
+	err = oc.saveAppInfo(appid, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// 拉取公众号信息
+func (oc *OpenClient) fetchAppInfo(appid string) (*open_platform.AuthorizerInfo, error) {
 	token, err := oc.getComponentAccessToken()
 	if err != nil {
 		return nil, err
@@ -225,47 +529,149 @@ func (oc *OpenClient) refreshAppInfo(appid string) (*open_platform.AuthorizerInf
 		return nil, err
 	}
 	info := &authInfo.AuthorizerInfo
-	err = oc.configs.AppStorage.SaveAppInfo(appid, info)
+	info.FuncInfo = authInfo.AuthorizationInfo.FuncInfo
+	return info, nil
+}
+
+// 保存公众号信息并更新客户端缓存
+func (oc *OpenClient) saveAppInfo(appid string, info *open_platform.AuthorizerInfo) error {
+	err := oc.configs.AppStorage.SaveAppInfo(appid, info)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return info, nil
+	oc.updateCachedClient(appid, info)
+	return nil
 }
 
-// 获得公众号客户端, 客户端有可能为 nil(被人为移除)
-func (oc *OpenClient) GetClient(appid string) (*PublicClient, error) {
+// 更新已缓存的客户端的公众号信息, 缓存了公众号不存在时移除该缓存, 正在进行的加载将重新读取公众号信息
+func (oc *OpenClient) updateCachedClient(appid string, info *open_platform.AuthorizerInfo) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	oc.nextClientGen(appid)
+	if client := oc.clients.peek(appid); client != nil {
+		client.setAppInfo(info)
+		oc.clients.set(appid, client)
+	} else {
+		oc.clients.remove(appid)
+	}
+}
+
+// 移除公众号客户端缓存, 并使正在进行的加载结果失效
+func (oc *OpenClient) removeClient(appid string) {
 	oc.mu.Lock()
 	defer oc.mu.Unlock()
-	client, ok := oc.publicClients[appid]
-	if !ok {
+	oc.nextClientGen(appid)
+	oc.clients.remove(appid)
+}
+
+// 递增正在加载的公众号客户端代数, 未在加载时忽略. 调用者需持有锁
+func (oc *OpenClient) nextClientGen(appid string) {
+	if gen, ok := oc.clientGens[appid]; ok {
+		oc.clientGens[appid] = gen + 1
+	}
+}
+
+// 使公众号客户端缓存过期, 下次获取客户端时将重新读取公众号信息, 用于其他实例更新了公众号信息之后
+func (oc *OpenClient) InvalidateClient(appid string) {
+	oc.clients.invalidate(appid)
+}
+
+// 获得公众号客户端, 客户端有可能为 nil(被人为移除).
+// 缓存过期的客户端将直接返回并在后台重新读取公众号信息, 未缓存的公众号在读取时合并同一公众号的请求, 不会阻塞其他公众号
+func (oc *OpenClient) GetClient(appid string) (*PublicClient, error) {
+	client, fresh := oc.clients.get(appid)
+	if fresh {
+		return client, nil
+	}
+	if client != nil {
+		oc.clientFlights.goDo(appid, func() (*PublicClient, error) {
+			return oc.loadClient(appid)
+		}, func(err error) {
+			oc.configs.Logger.Println(err)
+		})
+		return client, nil
+	}
+	return oc.clientFlights.do(appid, func() (*PublicClient, error) {
+		return oc.loadClient(appid)
+	})
+}
+
+// 读取公众号信息时客户端被移除或更新的最大重试次数
+const maxClientLoadRetries = 3
+
+// 读取公众号信息并更新客户端缓存, 读取期间客户端被移除(如取消授权)或更新时重新读取.
+// 同一公众号同时只有一个加载请求(见 clientFlights), 因此代数在加载结束后即可删除
+func (oc *OpenClient) loadClient(appid string) (*PublicClient, error) {
+	defer func() {
+		oc.mu.Lock()
+		delete(oc.clientGens, appid)
+		oc.mu.Unlock()
+	}()
+	for i := 0; i <= maxClientLoadRetries; i++ {
+		oc.mu.Lock()
+		if oc.clientGens == nil {
+			oc.clientGens = map[string]uint64{}
+		}
+		gen := oc.clientGens[appid]
+		oc.clientGens[appid] = gen
+		oc.mu.Unlock()
 		app, err := oc.configs.AppStorage.GetAppInfo(appid)
 		if err != nil {
 			return nil, err
-		} else {
-			if app == nil {
-				client = nil
-			} else {
-				opts := &PublicClientConfigs{
-					Appid:          appid,
-					Info:           app,
-					Dispatcher:     oc.Dispatcher,
-					MsgVerifyToken: oc.configs.MsgVerifyToken,
-					TokenGetter: func() (token string, err error) {
-						return oc.getAppAccessToken(appid)
-					},
-					MsgCrypt: oc.msgCrypt,
-					Logger:   oc.configs.Logger,
-				}
-				client = NewPublicClient(opts)
-			}
-			oc.publicClients[appid] = client
+		}
+		if client, ok := oc.cacheClient(appid, app, gen); ok {
+			return client, nil
 		}
 	}
-	return client, nil
+	return nil, fmt.Errorf("load client %s: app info changed during %d retries", appid, maxClientLoadRetries)
+}
+
+// 根据公众号信息更新客户端缓存, 读取信息之后客户端被移除或更新时放弃更新
+func (oc *OpenClient) cacheClient(appid string, app *open_platform.AuthorizerInfo, gen uint64) (*PublicClient, bool) {
+	// 创建及缓存客户端时持有锁, 保证 SetAppDispatcher 设置的处理器不会丢失
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if gen != oc.clientGens[appid] {
+		return nil, false
+	}
+	client := oc.clients.peek(appid)
+	if app == nil {
+		client = nil
+	} else if client != nil {
+		client.setAppInfo(app)
+	} else {
+		client = oc.newPublicClient(appid, app)
+	}
+	oc.clients.set(appid, client)
+	return client, true
+}
+
+// 创建公众号客户端, 调用者需持有锁
+func (oc *OpenClient) newPublicClient(appid string, app *open_platform.AuthorizerInfo) *PublicClient {
+	client := NewPublicClient(&PublicClientConfigs{
+		Appid:          appid,
+		Info:           app,
+		Dispatcher:     oc.getDispatcher(appid),
+		MsgVerifyToken: oc.configs.MsgVerifyToken,
+		TokenGetter: func() (token string, err error) {
+			return oc.getAppAccessToken(appid)
+		},
+		MsgCrypt:       oc.msgCrypt,
+		Logger:         oc.configs.Logger,
+		DedupStorage:   oc.configs.DedupStorage,
+		SessionStorage: oc.configs.SessionStorage,
+		CheckScope:     oc.configs.CheckScope,
+	})
+	client.waitTags = oc.waitTags
+	return client
 }
 
 // 读取用户发送/触发的消息
 func (oc *OpenClient) ListenMessage(appid string, w http.ResponseWriter, r *http.Request) {
+	if oc.configs.ReleaseTest && IsReleaseTestApp(appid) {
+		oc.listenReleaseTest(appid, w, r)
+		return
+	}
 	client, err := oc.GetClient(appid)
 	if err != nil {
 		oc.configs.Logger.Println(err)
@@ -323,45 +729,6 @@ func (oc *OpenClient) UnbindOpenApp(appid, openAppid string) error {
 	return open_platform.UnbindOpenApp(accessToken, appid, openAppid)
 }
 
-// 迁移公众号, 获得已授权公众号信息以及 refresh token, 并删除多余的公众号(可能公众号已解除授权)
-func (oc *OpenClient) MigrateApps() error {
-	accessToken, err := oc.getComponentAccessToken()
-	if err != nil {
-		return err
-	}
-	// 包含所有 app 信息，一次性全部重置
-	var appids []string
-	var offset, limit = 0, 100
-
-	for {
-		list, err := open_platform.GetAuthorizerList(accessToken, oc.configs.Appid, offset, limit)
-		if err != nil {
-			return err
-		}
-		if len(list.List) == 0 {
-			break
-		}
-		offset += limit
-		for _, information := range list.List {
-			token := &AppAccessToken{
-				RefreshToken: information.RefreshToken,
-			}
-			// 保存 access token
-			err = oc.configs.ComponentStorage.SaveAppAccessToken(information.AuthorizerAppid, token)
-			if err != nil {
-				return err
-			}
-			// 获取并保存授权方信息
-			_, err := oc.refreshAppInfo(information.AuthorizerAppid)
-			if err != nil {
-				return err
-			}
-			appids = append(appids, information.AuthorizerAppid)
-		}
-	}
-	return oc.configs.AppStorage.DelAppInfoNotIn(appids)
-}
-
 //// 公众号用户统计
 //type AppUserStatistics struct {
 //	Appid      string          `json:"appid"`
@@ -0,0 +1,205 @@
+package src
+
+import (
+	"errors"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDiffFuncScopes(t *testing.T) {
+	scopes := func(ids ...int) *open_platform.AuthorizerInfo {
+		info := &open_platform.AuthorizerInfo{}
+		for _, id := range ids {
+			info.FuncInfo = append(info.FuncInfo, &open_platform.FuncScope{FuncscopeCategory: open_platform.Info{ID: id}})
+		}
+		return info
+	}
+	granted, revoked := diffFuncScopes(scopes(1, 2, 3), scopes(2, 3, 11))
+	if jsonStr(granted) != "[11]" || jsonStr(revoked) != "[1]" {
+		t.Errorf("granted: %v, revoked: %v", granted, revoked)
+	}
+	granted, revoked = diffFuncScopes(nil, scopes(1, 2))
+	if jsonStr(granted) != "[1,2]" || revoked != nil {
+		t.Errorf("granted: %v, revoked: %v", granted, revoked)
+	}
+}
+
+func TestListApps(t *testing.T) {
+	storage := NewMemoryStorage()
+	oc := &OpenClient{configs: &OpenClientConfigs{AppStorage: storage}}
+	for appid, serviceType := range map[string]int{"wx_a": 2, "wx_b": 0, "wx_c": 2, "wx_d": 2} {
+		err := storage.SaveAppInfo(appid, &open_platform.AuthorizerInfo{NickName: "nick_" + appid, ServiceTypeInfo: &open_platform.Info{ID: serviceType}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := oc.ListApps(&AppQuery{ServiceTypes: []int{2}, Offset: 1, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 3 || len(list.Apps) != 1 || list.Apps[0].Appid != "wx_c" || list.Apps[0].NickName != "nick_wx_c" {
+		t.Errorf("unexpected list: %d %s", list.Total, jsonStr(list.Apps))
+	}
+	// 无法列出 appid 的存储器不会回退到远程接口
+	oc = &OpenClient{configs: &OpenClientConfigs{AppStorage: appStorageOnly{storage}}}
+	if _, err = oc.ListApps(nil); err != ErrAppListUnsupported {
+		t.Errorf("need ErrAppListUnsupported, got: %v", err)
+	}
+}
+
+func TestComponentLoginPage(t *testing.T) {
+	storage := NewComponentStorage("component", NewMemoryStorage())
+	oc := &OpenClient{configs: &OpenClientConfigs{Appid: "component", ComponentStorage: storage}}
+	// 预授权码已缓存, 不会请求接口
+	err := storage.(PreAuthCodeStorage).SavePreAuthCode(&ExpireData{Value: "code", ExpiredAt: Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := oc.ComponentLoginPageWithOptions("https://example.com/cb", &LoginPageOptions{AuthType: open_platform.AuthTypeOfficialAccount})
+	if err != nil {
+		t.Fatal(err)
+	}
+	need := "https://mp.weixin.qq.com/cgi-bin/componentloginpage?auth_type=1&component_appid=component&pre_auth_code=code&redirect_uri=https%3A%2F%2Fexample.com%2Fcb"
+	if page != need {
+		t.Errorf("need: %s, got: %s", need, page)
+	}
+	page, err = oc.ComponentBindPage("https://example.com/cb", &LoginPageOptions{BizAppid: "wx_app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	need = "https://open.weixin.qq.com/wxaopen/safe/bindcomponent?action=bindcomponent&biz_appid=wx_app&component_appid=component&no_scan=1&pre_auth_code=code&redirect_uri=https%3A%2F%2Fexample.com%2Fcb#wechat_redirect"
+	if page != need {
+		t.Errorf("need: %s, got: %s", need, page)
+	}
+	if _, err = oc.ComponentLoginPageWithOptions("", &LoginPageOptions{AuthType: "1", BizAppid: "wx_app"}); err == nil {
+		t.Error("AuthType and BizAppid should be exclusive")
+	}
+}
+
+func TestAppDispatcher(t *testing.T) {
+	storage := NewMemoryStorage()
+	tenant := NewDispatcher()
+	oc := newTestOpenClient(t, &OpenClientConfigs{
+		AppStorage: storage,
+		DispatcherResolver: func(appid string) *Dispatcher {
+			if appid == "wx_tenant" {
+				return tenant
+			}
+			return nil
+		},
+	})
+	for _, appid := range []string{"wx_default", "wx_tenant"} {
+		if err := storage.SaveAppInfo(appid, &open_platform.AuthorizerInfo{NickName: appid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dispatcher := func(appid string) *Dispatcher {
+		client, err := oc.GetClient(appid)
+		if err != nil || client == nil {
+			t.Fatalf("get client %s: %v, %v", appid, client, err)
+		}
+		return client.Dispatcher()
+	}
+	// 解析器返回 nil 时使用默认处理器
+	if dispatcher("wx_default") != oc.Dispatcher || dispatcher("wx_tenant") != tenant {
+		t.Fatal("unexpected resolved dispatcher")
+	}
+	// 运行时设置的处理器优先于解析器, 已创建的客户端立即生效
+	override := NewDispatcher()
+	oc.SetAppDispatcher("wx_tenant", override)
+	oc.SetAppDispatcher("wx_default", override)
+	if dispatcher("wx_tenant") != override || dispatcher("wx_default") != override {
+		t.Fatal("override not applied to created clients")
+	}
+	// 设置为 nil 时恢复为解析器或默认处理器
+	oc.SetAppDispatcher("wx_tenant", nil)
+	oc.SetAppDispatcher("wx_default", nil)
+	if dispatcher("wx_tenant") != tenant || dispatcher("wx_default") != oc.Dispatcher {
+		t.Fatal("dispatcher not reset")
+	}
+	// 未创建客户端时设置的处理器在创建客户端时使用
+	if err := storage.SaveAppInfo("wx_new", &open_platform.AuthorizerInfo{NickName: "wx_new"}); err != nil {
+		t.Fatal(err)
+	}
+	oc.SetAppDispatcher("wx_new", override)
+	if dispatcher("wx_new") != override {
+		t.Fatal("override not applied to new client")
+	}
+}
+
+func TestSetNotify(t *testing.T) {
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		return map[string]interface{}{
+			"authorizer_info": map[string]interface{}{"nick_name": "renamed"},
+			"authorization_info": map[string]interface{}{
+				"authorizer_appid": "wx_app",
+				"func_info": []map[string]interface{}{
+					{"funcscope_category": map[string]int{"id": 2}},
+					{"funcscope_category": map[string]int{"id": 3}},
+				},
+			},
+		}
+	})
+	storage := NewMemoryStorage()
+	oc := newTestOpenClient(t, &OpenClientConfigs{AppStorage: storage})
+	_ = oc.configs.ComponentStorage.SaveAccessToken(&ExpireData{Value: "token", ExpiredAt: Now().Add(time.Hour).Unix()})
+	old := &open_platform.AuthorizerInfo{NickName: "app", FuncInfo: []*open_platform.FuncScope{
+		{FuncscopeCategory: open_platform.Info{ID: 1}},
+		{FuncscopeCategory: open_platform.Info{ID: 2}},
+	}}
+	_ = storage.SaveAppInfo("wx_app", old)
+
+	var events []*AuthorizationEvent
+	fail := true
+	handler := func(evt *AuthorizationEvent) error {
+		events = append(events, evt)
+		if fail {
+			return errors.New("handler failed")
+		}
+		return nil
+	}
+	oc.OnUpdateAuthorized(handler)
+	oc.OnUnauthorized(handler)
+	notify := func(infoType open_platform.ComponentAuthorizationEvent) error {
+		return oc.setNotify(&open_platform.AuthorizationNotify{InfoType: infoType, AuthorizerAppid: "wx_app"})
+	}
+	app := func() *open_platform.AuthorizerInfo {
+		info, err := storage.GetAppInfo("wx_app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	// 处理器失败时不保存, 重新推送的通知得到相同的事件
+	for _, f := range []bool{true, false} {
+		fail = f
+		err := notify(open_platform.EvtUpdateAuthorized)
+		if (err != nil) != f {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		evt := events[len(events)-1]
+		if evt.Info.NickName != "renamed" || jsonStr(evt.Granted) != "[3]" || jsonStr(evt.Revoked) != "[1]" {
+			t.Errorf("unexpected event: %s", jsonStr(evt))
+		}
+		if need := map[bool]string{true: "app", false: "renamed"}[f]; app().NickName != need {
+			t.Errorf("need saved nickname %s, got: %s", need, app().NickName)
+		}
+	}
+
+	for _, f := range []bool{true, false} {
+		fail = f
+		err := notify(open_platform.EvtUnauthorized)
+		if (err != nil) != f {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if evt := events[len(events)-1]; evt.Info == nil || evt.Info.NickName != "renamed" {
+			t.Errorf("unexpected event: %s", jsonStr(evt))
+		}
+		if (app() != nil) != f {
+			t.Errorf("app should be deleted only after handlers succeed")
+		}
+	}
+}
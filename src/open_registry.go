@@ -0,0 +1,148 @@
+package src
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// 三方平台注册表, 用于在同一进程中运行多个三方平台. 各三方平台的 ComponentStorage 以 appid 区分,
+// 可共用同一个 AccessStorage, 但 AppStorage 需相互独立(如 sql_storage 的 ComponentAppid, redis_storage 的 prefix)
+type OpenRegistry struct {
+	clients    map[string]*OpenClient // 三方平台 appid => 客户端
+	owners     map[string]string      // 公众号 appid => 三方平台 appid
+	registered map[*OpenClient]bool   // 已添加授权事件处理器的客户端
+	mu         sync.RWMutex
+}
+
+func NewOpenRegistry() *OpenRegistry {
+	return &OpenRegistry{
+		clients:    map[string]*OpenClient{},
+		owners:     map[string]string{},
+		registered: map[*OpenClient]bool{},
+	}
+}
+
+// 注册三方平台, 相同 appid 的三方平台将被替换, 重复注册同一客户端不会重复添加授权事件处理器
+func (reg *OpenRegistry) Register(oc *OpenClient) {
+	componentAppid := oc.configs.Appid
+	reg.mu.Lock()
+	reg.clients[componentAppid] = oc
+	for appid, owner := range reg.owners {
+		if owner == componentAppid {
+			delete(reg.owners, appid)
+		}
+	}
+	registered := reg.registered[oc]
+	reg.registered[oc] = true
+	reg.mu.Unlock()
+	if registered {
+		return
+	}
+	// 处理器在客户端被替换或移除后忽略事件, 见 setOwner
+	oc.OnAuthorized(func(evt *AuthorizationEvent) error {
+		reg.setOwner(oc, evt.Notify.AuthorizerAppid, true)
+		return nil
+	})
+	oc.OnUnauthorized(func(evt *AuthorizationEvent) error {
+		reg.setOwner(oc, evt.Notify.AuthorizerAppid, false)
+		return nil
+	})
+}
+
+// 移除三方平台
+func (reg *OpenRegistry) Unregister(componentAppid string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.clients, componentAppid)
+	for appid, owner := range reg.owners {
+		if owner == componentAppid {
+			delete(reg.owners, appid)
+		}
+	}
+}
+
+// 更新公众号所属的三方平台, oc 已被替换或移除时忽略
+func (reg *OpenRegistry) setOwner(oc *OpenClient, appid string, authorized bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	componentAppid := oc.configs.Appid
+	if reg.clients[componentAppid] != oc {
+		return
+	}
+	if authorized {
+		reg.owners[appid] = componentAppid
+	} else if reg.owners[appid] == componentAppid {
+		delete(reg.owners, appid)
+	}
+}
+
+// 获得三方平台客户端, 不存在时返回 nil
+func (reg *OpenRegistry) Get(componentAppid string) *OpenClient {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.clients[componentAppid]
+}
+
+// 获得所有三方平台客户端, 按 appid 排序
+func (reg *OpenRegistry) Clients() []*OpenClient {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	clients := make([]*OpenClient, 0, len(reg.clients))
+	for _, oc := range reg.clients {
+		clients = append(clients, oc)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].configs.Appid < clients[j].configs.Appid
+	})
+	return clients
+}
+
+// 获得授权了公众号的三方平台, 依次查询各三方平台的 AppStorage, 查询结果将被缓存.
+// 公众号未授权给任何三方平台时返回 nil
+func (reg *OpenRegistry) Owner(appid string) (*OpenClient, error) {
+	reg.mu.RLock()
+	oc := reg.clients[reg.owners[appid]]
+	reg.mu.RUnlock()
+	if oc != nil {
+		return oc, nil
+	}
+	for _, oc = range reg.Clients() {
+		app, err := oc.configs.AppStorage.GetAppInfo(appid)
+		if err != nil {
+			return nil, err
+		}
+		if app != nil {
+			reg.setOwner(oc, appid, true)
+			return oc, nil
+		}
+	}
+	return nil, nil
+}
+
+// 获得公众号客户端, 公众号未授权给任何三方平台时返回 nil
+func (reg *OpenRegistry) GetClient(appid string) (*PublicClient, error) {
+	oc, err := reg.Owner(appid)
+	if err != nil || oc == nil {
+		return nil, err
+	}
+	return oc.GetClient(appid)
+}
+
+// 监听三方平台通知消息, componentAppid 通常来自授权事件接收 URL, 三方平台不存在时返回 404
+func (reg *OpenRegistry) ListenVerifyTicket(componentAppid string, w http.ResponseWriter, r *http.Request) {
+	if oc := reg.Get(componentAppid); oc != nil {
+		oc.ListenVerifyTicket(w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// 读取用户发送/触发的消息, componentAppid 及 appid 通常来自消息与事件接收 URL, 三方平台不存在时返回 404
+func (reg *OpenRegistry) ListenMessage(componentAppid, appid string, w http.ResponseWriter, r *http.Request) {
+	if oc := reg.Get(componentAppid); oc != nil {
+		oc.ListenMessage(appid, w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
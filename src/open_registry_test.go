@@ -0,0 +1,91 @@
+package src
+
+import (
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestOpenRegistry(t *testing.T) {
+	newClient := func(componentAppid string, appids ...string) *OpenClient {
+		storage := NewMemoryStorage()
+		for _, appid := range appids {
+			if err := storage.SaveAppInfo(appid, &open_platform.AuthorizerInfo{NickName: appid}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return newTestOpenClient(t, &OpenClientConfigs{
+			Appid:            componentAppid,
+			ComponentStorage: NewComponentStorage(componentAppid, storage),
+			AppStorage:       storage,
+		})
+	}
+	reg := NewOpenRegistry()
+	a, b := newClient("component_a", "wx_1"), newClient("component_b", "wx_2")
+	reg.Register(a)
+	reg.Register(b)
+	// 重复注册不会重复添加处理器
+	reg.Register(a)
+	for _, evt := range []open_platform.ComponentAuthorizationEvent{open_platform.EvtAuthorized, open_platform.EvtUnauthorized} {
+		if n := len(a.notifyHandlers[evt]); n != 1 {
+			t.Errorf("%s: need 1 handler, got: %d", evt, n)
+		}
+	}
+	if clients := reg.Clients(); len(clients) != 2 || clients[0] != a || clients[1] != b {
+		t.Fatalf("unexpected clients: %v", clients)
+	}
+	for appid, need := range map[string]*OpenClient{"wx_1": a, "wx_2": b, "wx_3": nil} {
+		if oc, err := reg.Owner(appid); err != nil || oc != need {
+			t.Errorf("%s: unexpected owner: %v, %v", appid, oc, err)
+		}
+	}
+	client, err := reg.GetClient("wx_2")
+	if err != nil || client == nil || client.GetAppInfo().NickName != "wx_2" {
+		t.Errorf("unexpected client: %v, %v", client, err)
+	}
+
+	// 取消授权后不再属于该三方平台
+	err = b.setNotify(&open_platform.AuthorizationNotify{InfoType: open_platform.EvtUnauthorized, AuthorizerAppid: "wx_2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oc, err := reg.Owner("wx_2"); err != nil || oc != nil {
+		t.Errorf("need nil owner, got: %v, %v", oc, err)
+	}
+
+	reg.Unregister("component_a")
+	if oc, err := reg.Owner("wx_1"); err != nil || oc != nil {
+		t.Errorf("need nil owner, got: %v, %v", oc, err)
+	}
+	w := httptest.NewRecorder()
+	reg.ListenVerifyTicket("component_a", w, httptest.NewRequest(http.MethodPost, "/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("need 404, got: %d", w.Code)
+	}
+}
+
+func TestOpenRegistryConcurrentRegister(t *testing.T) {
+	oc := newTestOpenClient(t, &OpenClientConfigs{})
+	// 添加处理器与处理授权事件同时进行
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			NewOpenRegistry().Register(oc)
+		}()
+		go func() {
+			defer wg.Done()
+			err := oc.setNotify(&open_platform.AuthorizationNotify{InfoType: open_platform.EvtUnauthorized, AuthorizerAppid: "wx_app"})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(oc.notifyHandlers[open_platform.EvtUnauthorized]); n != 10 {
+		t.Errorf("need 10 handlers, got: %d", n)
+	}
+}
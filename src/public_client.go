@@ -16,9 +16,19 @@ import (
 )
 
 type PublicClient struct {
-	configs      *PublicClientConfigs
-	waitTagUsers map[int][]string
-	mu           sync.Mutex
+	configs  *PublicClientConfigs
+	waitTags *tagWaitList // 等待打标签的用户
+	dmu      sync.RWMutex // 事件处理器及公众号信息锁
+}
+
+// 等待打标签的用户, OpenClient 创建的客户端共用同一列表, 客户端被缓存淘汰后不会丢失
+type tagWaitList struct {
+	users map[string]map[int][]string // appid => 标签 id => openid
+	mu    sync.Mutex
+}
+
+func newTagWaitList() *tagWaitList {
+	return &tagWaitList{users: map[string]map[int][]string{}}
 }
 
 type PublicClientConfigs struct {
@@ -29,30 +39,96 @@ type PublicClientConfigs struct {
 	TokenGetter    AccessTokenGetter             // token  提供器
 	MsgCrypt       *pkg.WXBizMsgCrypt            // 消息加密/解密器
 	Logger         *log.Logger                   // 错误日志收集器
+
+	// 被动回复等待时间, 超时后自动响应 success, 之后的回复将通过客服消息发送.
+	// 为 0 时使用 DefaultReplyTimeout, 小于 0 则一直等待处理器返回
+	ReplyTimeout time.Duration
+
+	// 客服消息回复失败处理器, 为 nil 时将错误写入 Logger
+	ReplyErrorHandler ReplyErrorHandler
+
+	// 消息去重存储器, 微信服务器未及时收到响应时会重试推送, 重复的消息将直接响应缓存的回复内容而不再触发处理器.
+	// 为 nil 时使用内存存储器, 多实例部署时应使用共享存储
+	DedupStorage AccessStorage
+	DedupTTL     time.Duration // 去重记录保存时间, 为 0 时使用 DefaultDedupTTL
+
+	// 用户会话存储器, 为 nil 时使用内存存储器, 多实例部署时应使用共享存储
+	SessionStorage SessionStorage
+	SessionTTL     time.Duration // 会话过期时间, 为 0 时使用 DefaultSessionTTL
+
+	// 调用接口前检查公众号是否授权了所需的权限集(见 MethodScopes), 未授权时返回 *ScopeError 而不请求接口
+	CheckScope bool
 }
 
+// 默认被动回复等待时间, 微信服务器在 5 秒内收不到响应将断开连接并重新发起请求
+const DefaultReplyTimeout = 4500 * time.Millisecond
+
 // 获得公众号信息
 func (pc *PublicClient) GetAppInfo() *open_platform.AuthorizerInfo {
+	pc.dmu.RLock()
+	defer pc.dmu.RUnlock()
 	return pc.configs.Info
 }
 
+// 更新公众号信息
+func (pc *PublicClient) setAppInfo(info *open_platform.AuthorizerInfo) {
+	pc.dmu.Lock()
+	defer pc.dmu.Unlock()
+	pc.configs.Info = info
+}
+
 // 获得 appid
 func (pc *PublicClient) GetAppid() string {
 	return pc.configs.Appid
 }
 
+// 获得事件处理器
+func (pc *PublicClient) Dispatcher() *Dispatcher {
+	pc.dmu.RLock()
+	defer pc.dmu.RUnlock()
+	return pc.configs.Dispatcher
+}
+
+// 替换事件处理器, 可在运行时调用, 之后收到的消息将由新的处理器处理
+func (pc *PublicClient) SetDispatcher(d *Dispatcher) {
+	pc.dmu.Lock()
+	defer pc.dmu.Unlock()
+	pc.configs.Dispatcher = d
+}
+
 func NewPublicClient(configs *PublicClientConfigs) *PublicClient {
 	if configs.Logger == nil {
 		configs.Logger = log.New(os.Stderr, configs.Appid, log.LstdFlags|log.Llongfile)
 	}
+	if configs.ReplyErrorHandler == nil {
+		logger := configs.Logger
+		configs.ReplyErrorHandler = func(err *ReplyError) {
+			logger.Println(err)
+		}
+	}
+	if configs.DedupStorage == nil {
+		configs.DedupStorage = NewMemoryStorage()
+	}
+	if configs.DedupTTL == 0 {
+		configs.DedupTTL = DefaultDedupTTL
+	}
+	if configs.SessionStorage == nil {
+		configs.SessionStorage = NewSessionStorage(NewMemoryStorage())
+	}
+	if configs.SessionTTL == 0 {
+		configs.SessionTTL = DefaultSessionTTL
+	}
+	if configs.ReplyTimeout == 0 {
+		configs.ReplyTimeout = DefaultReplyTimeout
+	}
 	return &PublicClient{
-		configs:      configs,
-		waitTagUsers: map[int][]string{},
+		configs:  configs,
+		waitTags: newTagWaitList(),
 	}
 }
 
 func (pc *PublicClient) SendMiniProgramPage(toOpenid []string, page *message.MiniProgramPage) error {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("SendMiniProgramPage")
 	if err != nil {
 		return err
 	}
@@ -88,24 +164,46 @@ func (pc *PublicClient) ListenMessage(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			pc.configs.Logger.Println(err)
 		} else {
-			writer := &responseWriter{
-				msgCrypt: pc.configs.MsgCrypt,
-				history:  nil,
-				w:        w,
-				msg:      msg,
+			key := dedupKey(pc.configs.Appid, msg, msgData)
+			if pc.replyDuplicate(key, w) {
+				return
 			}
-			err = pc.configs.Dispatcher.trigger(
-				msg,
-				msgData,
-				pc,
-				writer,
-			)
-			if err != nil {
-				pc.configs.Logger.Println(err)
-			}
-			if writer.history == nil {
-				_, _ = w.Write([]byte(""))
+			recorder := &bodyRecorder{ResponseWriter: w}
+			writer := newResponseWriter(pc, recorder, msg)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer func() {
+					if e := recover(); e != nil {
+						pc.configs.Logger.Printf("{appid: %s} dispatch message panic: %v\n", pc.configs.Appid, e)
+					}
+				}()
+				err := pc.Dispatcher().trigger(
+					msg,
+					msgData,
+					pc,
+					r,
+					writer,
+				)
+				if err != nil {
+					pc.configs.Logger.Println(err)
+				}
+			}()
+			if pc.configs.ReplyTimeout > 0 {
+				timer := time.NewTimer(pc.configs.ReplyTimeout)
+				select {
+				case <-done:
+					timer.Stop()
+					writer.close("")
+				case <-timer.C:
+					// 处理器超时, 先行响应, 后续回复将通过客服消息发送
+					writer.close("success")
+				}
+			} else {
+				<-done
+				writer.close("")
 			}
+			pc.saveReply(key, recorder.body.Bytes())
 		}
 	}
 	return
@@ -113,7 +211,7 @@ func (pc *PublicClient) ListenMessage(w http.ResponseWriter, r *http.Request) {
 
 // 上传永久素材
 func (pc *PublicClient) UploadMaterial(mediaType material.MediaType, data []byte, filename string, videoDesc *material.VideoDescription) (res *material.UploadedMedia, err error) {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("UploadMaterial")
 	if err != nil {
 		return nil, err
 	} else {
@@ -123,7 +221,7 @@ func (pc *PublicClient) UploadMaterial(mediaType material.MediaType, data []byte
 
 // 上传临时素材，3 天有效
 func (pc *PublicClient) UploadTempMaterial(mediaType material.MediaType, data []byte, filename string) (res *material.TempMedia, err error) {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("UploadTempMaterial")
 	if err != nil {
 		return nil, err
 	} else {
@@ -133,7 +231,7 @@ func (pc *PublicClient) UploadTempMaterial(mediaType material.MediaType, data []
 
 // 获得所有关注用户
 func (pc *PublicClient) WalkSubscribers(walk func(openids []string) error) error {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("WalkSubscribers")
 	if err != nil {
 		return err
 	}
@@ -142,7 +240,7 @@ func (pc *PublicClient) WalkSubscribers(walk func(openids []string) error) error
 
 // 创建公众号标签
 func (pc *PublicClient) CreateAppUserTag(tagName string) (*users.Tag, error) {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("CreateAppUserTag")
 	if err != nil {
 		return nil, err
 	}
@@ -151,7 +249,7 @@ func (pc *PublicClient) CreateAppUserTag(tagName string) (*users.Tag, error) {
 
 // 获得公众号标签
 func (pc *PublicClient) GetAppUserTags() ([]*users.Tag, error) {
-	accessToken, err := pc.configs.TokenGetter()
+	accessToken, err := pc.tokenFor("GetAppUserTags")
 	if err != nil {
 		return nil, err
 	}
@@ -160,7 +258,7 @@ func (pc *PublicClient) GetAppUserTags() ([]*users.Tag, error) {
 
 // 更新公众号标签
 func (pc *PublicClient) UpdateAppUserTag(tag *users.Tag) error {
-	accessToken, err := pc.configs.TokenGetter()
+	accessToken, err := pc.tokenFor("UpdateAppUserTag")
 	if err != nil {
 		return err
 	}
@@ -173,7 +271,7 @@ func (pc *PublicClient) UpdateAppUserTag(tag *users.Tag) error {
 // 45058   不能修改0/1/2这三个系统默认保留的标签
 // 45057   该标签下粉丝数超过10w，不允许直接删除
 func (pc *PublicClient) DeleteAppUserTag(tagID int) error {
-	accessToken, err := pc.configs.TokenGetter()
+	accessToken, err := pc.tokenFor("DeleteAppUserTag")
 	if err != nil {
 		return err
 	}
@@ -182,7 +280,7 @@ func (pc *PublicClient) DeleteAppUserTag(tagID int) error {
 
 // 获得对应标签下的用户列表
 func (pc *PublicClient) GetAppTagUsers(tagID int, nextOpenid string) (*users.Users, error) {
-	accessToken, err := pc.configs.TokenGetter()
+	accessToken, err := pc.tokenFor("GetAppTagUsers")
 	if err != nil {
 		return nil, err
 	}
@@ -190,7 +288,7 @@ func (pc *PublicClient) GetAppTagUsers(tagID int, nextOpenid string) (*users.Use
 }
 
 func (pc *PublicClient) WalkAppTagUsers(tagID int, walk func(openids []string) error) error {
-	accessToken, err := pc.configs.TokenGetter()
+	accessToken, err := pc.tokenFor("WalkAppTagUsers")
 	if err != nil {
 		return err
 	}
@@ -199,7 +297,7 @@ func (pc *PublicClient) WalkAppTagUsers(tagID int, walk func(openids []string) e
 
 // 批量为用户打标签
 func (pc *PublicClient) BatchTagging(tagID int, openids []string) error {
-	accessToken, err := pc.configs.TokenGetter()
+	accessToken, err := pc.tokenFor("BatchTagging")
 	if err != nil {
 		return err
 	}
@@ -208,16 +306,21 @@ func (pc *PublicClient) BatchTagging(tagID int, openids []string) error {
 
 // 加入等待标签, 待用户达到一定数量时才会触发批量为打标签的动作, 防止大量打标签导致接口次数被用完
 func (pc *PublicClient) WaitBatchTagging(tagID, cacheNum int, openid string) error {
-	pc.mu.Lock()
-	defer pc.mu.Unlock()
-	pc.waitTagUsers[tagID] = append(pc.waitTagUsers[tagID], openid)
-	if len(pc.waitTagUsers[tagID]) > cacheNum {
-		accessToken, err := pc.configs.TokenGetter()
+	pc.waitTags.mu.Lock()
+	defer pc.waitTags.mu.Unlock()
+	waitUsers := pc.waitTags.users[pc.configs.Appid]
+	if waitUsers == nil {
+		waitUsers = map[int][]string{}
+		pc.waitTags.users[pc.configs.Appid] = waitUsers
+	}
+	waitUsers[tagID] = append(waitUsers[tagID], openid)
+	if len(waitUsers[tagID]) > cacheNum {
+		accessToken, err := pc.tokenFor("WaitBatchTagging")
 		if err != nil {
 			return err
 		}
-		openids := pc.waitTagUsers[tagID]
-		pc.waitTagUsers[tagID] = []string{}
+		openids := waitUsers[tagID]
+		waitUsers[tagID] = []string{}
 		return users.BatchTagging(accessToken, tagID, openids)
 	}
 	return nil
@@ -225,7 +328,7 @@ func (pc *PublicClient) WaitBatchTagging(tagID, cacheNum int, openid string) err
 
 // 批量为用户取消标签
 func (pc *PublicClient) BatchUntagging(tagID int, openids []string) error {
-	accessToken, err := pc.configs.TokenGetter()
+	accessToken, err := pc.tokenFor("BatchUntagging")
 	if err != nil {
 		return err
 	}
@@ -234,7 +337,7 @@ func (pc *PublicClient) BatchUntagging(tagID int, openids []string) error {
 
 // 获取用户身上的标签列表
 func (pc *PublicClient) GetUserTags(openid string) (ids []int, err error) {
-	accessToken, err := pc.configs.TokenGetter()
+	accessToken, err := pc.tokenFor("GetUserTags")
 	if err != nil {
 		return nil, err
 	}
@@ -243,7 +346,7 @@ func (pc *PublicClient) GetUserTags(openid string) (ids []int, err error) {
 
 // 获取用户增减数据
 func (pc *PublicClient) GetUserSummary(beginDate, endDate time.Time) ([]*statistics.Summary, error) {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("GetUserSummary")
 	if err != nil {
 		return nil, err
 	} else {
@@ -263,7 +366,7 @@ func (pc *PublicClient) GetUserSummary(beginDate, endDate time.Time) ([]*statist
 
 // 获取累计用户数据
 func (pc *PublicClient) GetUserCumulate(beginDate, endDate time.Time) ([]*statistics.Cumulate, error) {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("GetUserCumulate")
 	if err != nil {
 		return nil, err
 	} else {
@@ -397,7 +500,7 @@ func (pc *PublicClient) GetUserStatistics(beginDate, endDate time.Time) (*UserSt
 
 // 获取公众号分广告位数据, 最大时间跨度: 90天, slot 是广告位类型，为可选参数
 func (pc *PublicClient) GetPublisherAdPosGeneral(slot statistics.AdSlot, opts statistics.PublisherCommonOptions) (*statistics.PublisherAdPosGeneralResponse, error) {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("GetPublisherAdPosGeneral")
 	if err != nil {
 		return nil, err
 	} else {
@@ -407,7 +510,7 @@ func (pc *PublicClient) GetPublisherAdPosGeneral(slot statistics.AdSlot, opts st
 
 // 获取公众号返佣商品数据, 最大时间跨度: 60天
 func (pc *PublicClient) GetPublisherCpsGeneral(opts statistics.PublisherCommonOptions) (*statistics.PublisherCpsGeneralResponse, error) {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("GetPublisherCpsGeneral")
 	if err != nil {
 		return nil, err
 	} else {
@@ -417,7 +520,7 @@ func (pc *PublicClient) GetPublisherCpsGeneral(opts statistics.PublisherCommonOp
 
 // 获取公众号结算收入数据及结算主体信息, 最大时间跨度: 无
 func (pc *PublicClient) GetPublisherSettlement(opts statistics.PublisherCommonOptions) (*statistics.PublisherSettlementResponse, error) {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("GetPublisherSettlement")
 	if err != nil {
 		return nil, err
 	} else {
@@ -427,7 +530,7 @@ func (pc *PublicClient) GetPublisherSettlement(opts statistics.PublisherCommonOp
 
 // 创建自定义菜单
 func (pc *PublicClient) CreateMenu(buttons []custom_menu.Button) error {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("CreateMenu")
 	if err != nil {
 		return err
 	} else {
@@ -437,7 +540,7 @@ func (pc *PublicClient) CreateMenu(buttons []custom_menu.Button) error {
 
 // 删除自定义菜单
 func (pc *PublicClient) DeleteMenu() error {
-	token, err := pc.configs.TokenGetter()
+	token, err := pc.tokenFor("DeleteMenu")
 	if err != nil {
 		return err
 	} else {
@@ -0,0 +1,198 @@
+// redis_storage 基于 redis 实现 AccessStorage, ComponentStorage, AppStorage, AppSearcher 及 Locker 接口
+package redis_storage
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"github.com/morgine/wechat_sdk/src"
+	"strconv"
+	"time"
+)
+
+// redis 存储器, 所有 key 都带有 prefix 前缀
+type Storage struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+var (
+	_ src.AccessStorage = (*Storage)(nil)
+	_ src.AppStorage    = (*Storage)(nil)
+	_ src.AppidLister   = (*Storage)(nil)
+	_ src.AppSearcher   = (*Storage)(nil)
+	_ src.Locker        = (*Storage)(nil)
+)
+
+func NewStorage(client redis.UniversalClient, prefix string) *Storage {
+	return &Storage{client: client, prefix: prefix}
+}
+
+// 获得三方平台存储器, token 的过期时间与 ExpireData.ExpiredAt 一致
+func (s *Storage) ComponentStorage(componentAppid string) src.ComponentStorage {
+	return src.NewComponentStorage(componentAppid, s)
+}
+
+// 保存数据, expiration 为 0 时永不过期, 小于 0 时表示数据已过期, 将删除已存在的数据
+func (s *Storage) Set(key string, value []byte, expiration time.Duration) error {
+	ctx := context.Background()
+	if expiration < 0 {
+		return s.client.Del(ctx, s.prefix+key).Err()
+	}
+	return s.client.Set(ctx, s.prefix+key, value, expiration).Err()
+}
+
+// 获得数据, 数据不存在时返回 nil
+func (s *Storage) Get(key string) (value []byte, err error) {
+	value, err = s.client.Get(context.Background(), s.prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (s *Storage) TryLock(key, value string, expiration time.Duration) (ok bool, err error) {
+	return s.client.SetNX(context.Background(), s.prefix+key, value, expiration).Result()
+}
+
+// 只有 value 与加锁时一致才删除, 防止锁过期后误删其他实例的锁
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+else
+	return 0
+end`)
+
+func (s *Storage) Unlock(key, value string) error {
+	return unlockScript.Run(context.Background(), s.client, []string{s.prefix + key}, value).Err()
+}
+
+func (s *Storage) appInfoKey(appid string) string {
+	return s.prefix + "app_info_" + appid
+}
+
+// 保存所有公众号 appid 的集合
+func (s *Storage) appidsKey() string {
+	return s.prefix + "app_ids"
+}
+
+func (s *Storage) SaveAppInfo(appid string, app *open_platform.AuthorizerInfo) error {
+	data, err := json.Marshal(app)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.appInfoKey(appid), data, 0)
+		pipe.SAdd(ctx, s.appidsKey(), appid)
+		return nil
+	})
+	return err
+}
+
+func (s *Storage) GetAppInfo(appid string) (*open_platform.AuthorizerInfo, error) {
+	data, err := s.client.Get(context.Background(), s.appInfoKey(appid)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	app := &open_platform.AuthorizerInfo{}
+	err = json.Unmarshal(data, app)
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+func (s *Storage) DelAppInfo(appid string) error {
+	return s.delAppInfos([]string{appid})
+}
+
+// 将需要保留的 appid 写入临时集合, 通过 SDIFF 获得需要删除的 appid
+func (s *Storage) DelAppInfoNotIn(appids []string) error {
+	ctx := context.Background()
+	if len(appids) == 0 {
+		saved, err := s.client.SMembers(ctx, s.appidsKey()).Result()
+		if err != nil {
+			return err
+		}
+		return s.delAppInfos(saved)
+	}
+	tmpKey := s.appidsKey() + "_keep_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	members := make([]interface{}, len(appids))
+	for i, appid := range appids {
+		members[i] = appid
+	}
+	var diff *redis.StringSliceCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, tmpKey, members...)
+		pipe.Expire(ctx, tmpKey, time.Minute)
+		diff = pipe.SDiff(ctx, s.appidsKey(), tmpKey)
+		pipe.Del(ctx, tmpKey)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.delAppInfos(diff.Val())
+}
+
+func (s *Storage) delAppInfos(appids []string) error {
+	if len(appids) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	keys := make([]string, len(appids))
+	members := make([]interface{}, len(appids))
+	for i, appid := range appids {
+		keys[i] = s.appInfoKey(appid)
+		members[i] = appid
+	}
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		pipe.SRem(ctx, s.appidsKey(), members...)
+		return nil
+	})
+	return err
+}
+
+func (s *Storage) GetAppids() ([]string, error) {
+	return s.client.SMembers(context.Background(), s.appidsKey()).Result()
+}
+
+// 查询公众号, 通过 MGET 一次读取所有公众号信息后在内存中过滤
+func (s *Storage) SearchApps(query *src.AppQuery) (*src.AppList, error) {
+	ctx := context.Background()
+	appids, err := s.client.SMembers(ctx, s.appidsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(appids) == 0 {
+		return &src.AppList{}, nil
+	}
+	keys := make([]string, len(appids))
+	for i, appid := range appids {
+		keys[i] = s.appInfoKey(appid)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	apps := make([]*src.AppInfo, 0, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		app := &open_platform.AuthorizerInfo{}
+		err = json.Unmarshal([]byte(data), app)
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, &src.AppInfo{Appid: appids[i], AuthorizerInfo: app})
+	}
+	return src.FilterApps(apps, query), nil
+}
@@ -0,0 +1,122 @@
+package redis_storage
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"github.com/morgine/wechat_sdk/src"
+	"github.com/morgine/wechat_sdk/src/storagetest"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T) (*Storage, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return NewStorage(client, "test_"), mr
+}
+
+func TestComponentStorage(t *testing.T) {
+	s, mr := newTestStorage(t)
+	cs := s.ComponentStorage("component")
+	if ticket, err := cs.GetVerifyTicket(); err != nil || ticket != "" {
+		t.Fatalf("need empty ticket, got: %q, %v", ticket, err)
+	}
+	if token, err := cs.GetAccessToken(); err != nil || token != nil {
+		t.Fatalf("need nil token, got: %+v, %v", token, err)
+	}
+	err := cs.SaveAccessToken(&src.ExpireData{Value: "token", ExpiredAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL("test_component_access_token"); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("unexpected ttl: %s", ttl)
+	}
+	mr.FastForward(time.Hour)
+	if token, err := cs.GetAccessToken(); err != nil || token != nil {
+		t.Errorf("need expired token, got: %+v, %v", token, err)
+	}
+	err = cs.SaveAppAccessToken("wx_app", &src.AppAccessToken{AccessToken: "app_token", RefreshToken: "refresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, err := cs.GetAppAccessToken("wx_app"); err != nil || token == nil || token.RefreshToken != "refresh" {
+		t.Errorf("unexpected app token: %+v, %v", token, err)
+	}
+}
+
+func TestAppStorage(t *testing.T) {
+	s, _ := newTestStorage(t)
+	if app, err := s.GetAppInfo("wx_missing"); err != nil || app != nil {
+		t.Fatalf("need nil app, got: %+v, %v", app, err)
+	}
+	for _, appid := range []string{"wx_a", "wx_b", "wx_c"} {
+		err := s.SaveAppInfo(appid, &open_platform.AuthorizerInfo{NickName: appid, ServiceTypeInfo: &open_platform.Info{ID: 2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	app, err := s.GetAppInfo("wx_a")
+	if err != nil || app == nil || app.NickName != "wx_a" || app.ServiceTypeInfo.ID != 2 {
+		t.Fatalf("unexpected app: %+v, %v", app, err)
+	}
+	if err = s.DelAppInfoNotIn([]string{"wx_a", "wx_c", "wx_d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DelAppInfo("wx_c"); err != nil {
+		t.Fatal(err)
+	}
+	appids, err := s.GetAppids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(appids)
+	if len(appids) != 1 || appids[0] != "wx_a" {
+		t.Errorf("need [wx_a], got: %v", appids)
+	}
+	if app, err = s.GetAppInfo("wx_b"); err != nil || app != nil {
+		t.Errorf("wx_b should be deleted, got: %+v, %v", app, err)
+	}
+}
+
+func TestLocker(t *testing.T) {
+	s, _ := newTestStorage(t)
+	if ok, err := s.TryLock("lock", "a", time.Second); err != nil || !ok {
+		t.Fatalf("need lock, got: %v, %v", ok, err)
+	}
+	if ok, _ := s.TryLock("lock", "b", time.Second); ok {
+		t.Fatal("lock should be held")
+	}
+	if err := s.Unlock("lock", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.TryLock("lock", "b", time.Second); ok {
+		t.Fatal("lock should not be released by other holder")
+	}
+	if err := s.Unlock("lock", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.TryLock("lock", "b", time.Second); !ok {
+		t.Fatal("need lock after unlock")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	s, mr := newTestStorage(t)
+	newStorage := func() *Storage {
+		mr.FlushAll()
+		return s
+	}
+	opts := &storagetest.Options{Advance: mr.FastForward}
+	storagetest.TestAccessStorage(t, func() src.AccessStorage { return newStorage() }, opts)
+	storagetest.TestAppStorage(t, func() src.AppStorage { return newStorage() }, opts)
+	storagetest.TestComponentStorage(t, func() src.ComponentStorage { return newStorage().ComponentStorage("component") }, opts)
+}
@@ -0,0 +1,116 @@
+package src
+
+import (
+	"github.com/morgine/wechat_sdk/pkg"
+	"github.com/morgine/wechat_sdk/pkg/message"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"net/http"
+	"strings"
+)
+
+// 全网发布检测使用的测试公众号及小程序 appid
+var ReleaseTestAppids = []string{
+	"wx570bc396a51b8ff8", "wx9252c5e0bb1836fc", "wx8e1097c5bc82cde9", // 公众号
+	"wxd101a85aa106f53e", "wx14550af28c71a144", "wxa35b9c23cfe664eb", // 小程序
+}
+
+const (
+	releaseTestText          = "TESTCOMPONENT_MSG_TYPE_TEXT"
+	releaseTestQueryAuthCode = "QUERY_AUTH_CODE:"
+)
+
+// 是否是全网发布检测帐号
+func IsReleaseTestApp(appid string) bool {
+	for _, id := range ReleaseTestAppids {
+		if id == appid {
+			return true
+		}
+	}
+	return false
+}
+
+// 响应全网发布检测消息:
+// 1. 事件消息回复文本 "{Event}from_callback"
+// 2. 文本消息 TESTCOMPONENT_MSG_TYPE_TEXT 回复文本 TESTCOMPONENT_MSG_TYPE_TEXT_callback
+// 3. 文本消息 QUERY_AUTH_CODE:{query_auth_code} 先回复空串, 再使用授权码换取 access token, 并通过客服消息回复 "{query_auth_code}_from_api"
+// see: https://developers.weixin.qq.com/doc/oplatform/Third-party_Platforms/2.0/operation/thirdparty/releases_instructions.html
+func (oc *OpenClient) listenReleaseTest(appid string, w http.ResponseWriter, r *http.Request) {
+	echoStr, err := message.CheckSignature(r, oc.configs.MsgVerifyToken)
+	if err != nil {
+		oc.configs.Logger.Println(err)
+		return
+	}
+	if echoStr != "" {
+		_, _ = w.Write([]byte(echoStr))
+		return
+	}
+	msg, data, err := message.ReadServerMessage(r, oc.msgCrypt)
+	if err != nil {
+		oc.configs.Logger.Println(err)
+		return
+	}
+	var reply string
+	switch msg.MsgType {
+	case message.ServerMsgTypeEvent:
+		evt, err := data.MarshalEvent()
+		if err != nil {
+			oc.configs.Logger.Println(err)
+			return
+		}
+		reply = string(evt.Event) + "from_callback"
+	case message.ServerMsgTypeText:
+		text, err := data.MarshalTextMessage()
+		if err != nil {
+			oc.configs.Logger.Println(err)
+			return
+		}
+		if text.Content == releaseTestText {
+			reply = releaseTestText + "_callback"
+		} else if strings.HasPrefix(text.Content, releaseTestQueryAuthCode) {
+			code := strings.TrimPrefix(text.Content, releaseTestQueryAuthCode)
+			go func() {
+				err := oc.replyReleaseTestAuthCode(code, msg.FromUserName)
+				if err != nil {
+					oc.configs.Logger.Printf("{appid: %s} release test query auth code: %s\n", appid, err)
+				}
+			}()
+		}
+	}
+	if reply == "" {
+		_, _ = w.Write([]byte(""))
+		return
+	}
+	err = message.Response(msg, &message.ResponseMessage{
+		CreateTime: Now().Unix(),
+		MsgType:    message.ResponseMsgTypeText,
+		Content:    &pkg.Cdata{Value: reply},
+	}, w, oc.msgCrypt)
+	if err != nil {
+		oc.configs.Logger.Println(err)
+	}
+}
+
+// 使用授权码换取测试帐号的 access token, 并发送客服消息
+func (oc *OpenClient) replyReleaseTestAuthCode(code, openid string) error {
+	token, err := oc.getComponentAccessToken()
+	if err != nil {
+		return err
+	}
+	authInfo, err := open_platform.GetAuthorizationInfo(oc.configs.Appid, code, token)
+	if err != nil {
+		return err
+	}
+	err = oc.configs.ComponentStorage.SaveAppAccessToken(authInfo.AuthorizerAppid, &AppAccessToken{
+		AccessToken:  authInfo.AuthorizerAccessToken,
+		ExpireAt:     Now().Unix() + authInfo.ExpiresIn - (authInfo.ExpiresIn >> 3),
+		RefreshToken: authInfo.AuthorizerRefreshToken,
+	})
+	if err != nil {
+		return err
+	}
+	msg := &message.CustomerMessage{
+		MsgType: message.CustomerMsgTypeText,
+		Text:    &message.Text{Content: code + "_from_api"},
+	}
+	return msg.Send(authInfo.AuthorizerAccessToken, openid)
+}
@@ -0,0 +1,89 @@
+package src
+
+import (
+	"encoding/json"
+	"github.com/morgine/wechat_sdk/pkg/message"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReleaseTestClient(t *testing.T) *OpenClient {
+	oc := newTestOpenClient(t, &OpenClientConfigs{MsgVerifyToken: "token", AesToken: "aes_token", ReleaseTest: true})
+	err := oc.configs.ComponentStorage.SaveAccessToken(&ExpireData{Value: "component_token", ExpiredAt: Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oc
+}
+
+func TestReleaseTestReply(t *testing.T) {
+	oc := newReleaseTestClient(t)
+	appid := ReleaseTestAppids[0]
+	for data, need := range map[string]string{
+		textMessageXML("openid", releaseTestText, 1): "TESTCOMPONENT_MSG_TYPE_TEXT_callback",
+		"<xml><ToUserName><![CDATA[gh_test]]></ToUserName><FromUserName><![CDATA[openid]]></FromUserName>" +
+			"<CreateTime>1600000000</CreateTime><MsgType><![CDATA[event]]></MsgType><Event><![CDATA[LOCATION]]></Event></xml>": "LOCATIONfrom_callback",
+	} {
+		recorder := httptest.NewRecorder()
+		oc.ListenMessage(appid, recorder, newEncryptedMessageRequest("token", oc.msgCrypt, data))
+		res, err := decryptResponse(oc.msgCrypt, recorder.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.MsgType != message.ResponseMsgTypeText || res.Content == nil || res.Content.Value != need {
+			t.Errorf("need: %s, got: %+v", need, res)
+		}
+		if res.ToUserName.Value != "openid" {
+			t.Errorf("unexpected receiver: %s", res.ToUserName.Value)
+		}
+	}
+}
+
+func TestReleaseTestQueryAuthCode(t *testing.T) {
+	sent := make(chan string, 1)
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/cgi-bin/component/api_query_auth"):
+			var req map[string]string
+			_ = json.Unmarshal(body, &req)
+			if r.URL.Query().Get("component_access_token") != "component_token" || req["authorization_code"] != "auth_code" {
+				return map[string]interface{}{"errcode": 61010, "errmsg": "invalid request"}
+			}
+			return map[string]interface{}{"authorization_info": map[string]interface{}{
+				"authorizer_appid":         ReleaseTestAppids[0],
+				"authorizer_access_token":  "app_token",
+				"expires_in":               7200,
+				"authorizer_refresh_token": "refresh_token",
+			}}
+		case strings.HasSuffix(r.URL.Path, "/cgi-bin/message/custom/send"):
+			sent <- r.URL.Query().Get("access_token") + " " + strings.TrimSpace(string(body))
+		}
+		return map[string]interface{}{"errcode": 0}
+	})
+	oc := newReleaseTestClient(t)
+	recorder := httptest.NewRecorder()
+	oc.ListenMessage(ReleaseTestAppids[0], recorder, newEncryptedMessageRequest("token", oc.msgCrypt, textMessageXML("openid", releaseTestQueryAuthCode+"auth_code", 1)))
+	// 先回复空串, 再通过客服消息回复
+	if recorder.Body.Len() != 0 {
+		t.Errorf("need empty reply, got: %s", recorder.Body.String())
+	}
+	select {
+	case got := <-sent:
+		need := `app_token {"touser":"openid","msgtype":"text","text":{"content":"auth_code_from_api"}}`
+		if got != need {
+			t.Errorf("need: %s, got: %s", need, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("customer message not sent")
+	}
+	token, err := oc.configs.ComponentStorage.GetAppAccessToken(ReleaseTestAppids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.AccessToken != "app_token" || token.RefreshToken != "refresh_token" {
+		t.Errorf("unexpected saved token: %+v", token)
+	}
+}
@@ -5,9 +5,10 @@ import (
 	"github.com/morgine/wechat_sdk/pkg"
 	"github.com/morgine/wechat_sdk/pkg/message"
 	"net/http"
+	"sync"
 )
 
-// 自动回复接口
+// 自动回复接口, 可多次回复: 第一条消息作为被动回复, 其余消息在被动回复之后按顺序以客服消息发送
 type ResponseWriter interface {
 	ResponseText(text string) error
 	ResponseImage(mediaID string) error
@@ -17,11 +18,42 @@ type ResponseWriter interface {
 	ResponseArticles([]Article) error
 }
 
+// 客服消息回复失败信息
+type ReplyError struct {
+	Appid  string
+	Openid string
+	Msg    *message.ResponseMessage // 发送失败的消息
+	Err    error
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("{appid: %s} reply %s message to {openid: %s}: %s", e.Appid, e.Msg.MsgType, e.Openid, e.Err)
+}
+
+// 回复失败处理器
+type ReplyErrorHandler func(err *ReplyError)
+
+// 被动回复写入器, 第一条回复作为被动回复, 其余回复以及被动回复窗口关闭(处理器返回或超时)之后的回复,
+// 将在被动回复之后按顺序以客服消息发送
 type responseWriter struct {
+	client   *PublicClient
 	msgCrypt *pkg.WXBizMsgCrypt
-	history  *message.ResponseMessage
+	passive  *message.ResponseMessage   // 被动回复消息
+	queue    []*message.ResponseMessage // 等待以客服消息发送的回复
 	w        http.ResponseWriter
 	msg      *message.ServerMessage
+	closed   bool // 被动回复窗口是否已关闭
+	sending  bool // 是否正在发送客服消息
+	mu       sync.Mutex
+}
+
+func newResponseWriter(client *PublicClient, w http.ResponseWriter, msg *message.ServerMessage) *responseWriter {
+	return &responseWriter{
+		client:   client,
+		msgCrypt: client.configs.MsgCrypt,
+		w:        w,
+		msg:      msg,
+	}
 }
 
 func (r *responseWriter) ResponseText(text string) error {
@@ -87,15 +119,100 @@ func (r *responseWriter) ResponseArticles(articles []Article) error {
 }
 
 func (r *responseWriter) response(msg *message.ResponseMessage) error {
-	if r.history != nil {
-		return fmt.Errorf("cannot respone: %+v\nalready response: %+v\n", *msg, *r.history)
-	} else {
-		r.history = msg
-		msg.CreateTime = Now().Unix()
-		err := message.Response(r.msg, msg, r.w, r.msgCrypt)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msg.CreateTime = Now().Unix()
+	if !r.closed && r.passive == nil {
+		r.passive = msg
+		return message.Response(r.msg, msg, r.w, r.msgCrypt)
+	}
+	msg.FromUserName = pkg.Cdata{Value: r.msg.ToUserName}
+	msg.ToUserName = pkg.Cdata{Value: r.msg.FromUserName}
+	if msg.Articles != nil {
+		msg.ArticleCount = len(*msg.Articles)
+	}
+	r.queue = append(r.queue, msg)
+	if r.closed {
+		r.startSending()
+	}
+	return nil
+}
+
+// 关闭被动回复窗口, 如果尚未回复任何消息, 则响应 ack 内容, 之后开始发送排队中的客服消息.
+// 关闭之后不可再使用 http.ResponseWriter
+func (r *responseWriter) close(ack string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if r.passive == nil {
+		_, _ = r.w.Write([]byte(ack))
+	}
+	// 尽早将被动回复发送出去, 保证客服消息在被动回复之后到达
+	if f, ok := r.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	r.startSending()
+}
+
+// 启动客服消息发送, 调用者需持有锁
+func (r *responseWriter) startSending() {
+	if !r.sending && len(r.queue) > 0 {
+		r.sending = true
+		go r.sendQueue()
+	}
+}
+
+// 按顺序发送排队中的客服消息, 超出 48 小时回复窗口或接口被限制时, 剩余消息不再发送
+func (r *responseWriter) sendQueue() {
+	var breakErr error
+	for {
+		r.mu.Lock()
+		if len(r.queue) == 0 {
+			r.sending = false
+			r.mu.Unlock()
+			return
+		}
+		msg := r.queue[0]
+		r.queue = r.queue[1:]
+		r.mu.Unlock()
+
+		err := breakErr
+		if err == nil {
+			err = r.send(msg)
+			if err != nil && (message.IsBreakError(err) || isReplyWindowError(err)) {
+				breakErr = err
+			}
+		}
 		if err != nil {
-			return err
+			r.client.configs.ReplyErrorHandler(&ReplyError{
+				Appid:  r.client.configs.Appid,
+				Openid: r.msg.FromUserName,
+				Msg:    msg,
+				Err:    err,
+			})
 		}
 	}
-	return nil
+}
+
+// 以客服消息发送回复, 与 Context.SendCustomerMessage 检查相同的权限集
+func (r *responseWriter) send(msg *message.ResponseMessage) error {
+	token, err := r.client.tokenFor("SendCustomerMessage")
+	if err != nil {
+		return err
+	}
+	return msg.ToCustomerMessage().Send(token, "")
+}
+
+// 是否超出客服消息回复窗口(用户 48 小时内未互动)或超出回复条数限制
+func isReplyWindowError(err error) bool {
+	if werr, ok := err.(*pkg.Error); ok {
+		switch werr.ErrCode {
+		case 45015 /*超时回复*/, 45047 /*发送条数超过上限*/ :
+			return true
+		}
+	}
+	return false
 }
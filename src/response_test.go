@@ -0,0 +1,130 @@
+package src
+
+import (
+	"errors"
+	"github.com/morgine/wechat_sdk/pkg"
+	"github.com/morgine/wechat_sdk/pkg/message"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseWriterMultipleReplies(t *testing.T) {
+	errTokenMissing := errors.New("token missing")
+	failed := make(chan *ReplyError, 3)
+	client := NewPublicClient(&PublicClientConfigs{
+		Appid: "wx_test",
+		TokenGetter: func() (token string, err error) {
+			return "", errTokenMissing
+		},
+		ReplyErrorHandler: func(err *ReplyError) {
+			failed <- err
+		},
+	})
+	recorder := httptest.NewRecorder()
+	w := newResponseWriter(client, recorder, &message.ServerMessage{ToUserName: "gh_test", FromUserName: "openid"})
+	for _, text := range []string{"first", "second", "third"} {
+		if err := w.ResponseText(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, "first") || strings.Contains(body, "second") {
+		t.Fatalf("unexpected passive reply: %s", body)
+	}
+	w.close("")
+	for _, need := range []string{"second", "third"} {
+		select {
+		case err := <-failed:
+			if got := err.Msg.Content.Value; got != need {
+				t.Errorf("need: %s, got: %s", need, got)
+			}
+			if err.Openid != "openid" || err.Err != errTokenMissing {
+				t.Errorf("unexpected reply error: %s", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("reply %s not sent", need)
+		}
+	}
+}
+
+func TestReplyTimeout(t *testing.T) {
+	sent := make(chan string, 2)
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		if strings.HasSuffix(r.URL.Path, "/cgi-bin/message/custom/send") {
+			sent <- string(body)
+		}
+		return map[string]interface{}{"errcode": 0}
+	})
+	release := make(chan struct{})
+	d := NewDispatcher()
+	d.SubscribeTextMsg(func(msg *message.TextMessage, ctx *Context) {
+		<-release
+		_ = ctx.ResponseText("late")
+	})
+	client := NewPublicClient(&PublicClientConfigs{
+		Appid:          "wx_test",
+		Dispatcher:     d,
+		MsgVerifyToken: "token",
+		TokenGetter: func() (string, error) {
+			return "access_token", nil
+		},
+		ReplyTimeout: 20 * time.Millisecond,
+	})
+	recorder := httptest.NewRecorder()
+	client.ListenMessage(recorder, newMessageRequest("token", textMessageXML("openid", "slow", 1)))
+	// 处理器超时, 先响应 success
+	if body := recorder.Body.String(); body != "success" {
+		t.Fatalf("need: success, got: %s", body)
+	}
+	close(release)
+	select {
+	case body := <-sent:
+		if !strings.Contains(body, `"touser":"openid"`) || !strings.Contains(body, `"content":"late"`) {
+			t.Errorf("unexpected customer message: %s", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("late reply not sent as customer message")
+	}
+}
+
+func TestReplyTimeoutError(t *testing.T) {
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		return map[string]interface{}{"errcode": 45015, "errmsg": "response out of time limit"}
+	})
+	release := make(chan struct{})
+	failed := make(chan *ReplyError, 2)
+	d := NewDispatcher()
+	d.SubscribeTextMsg(func(msg *message.TextMessage, ctx *Context) {
+		<-release
+		_ = ctx.ResponseText("first")
+		_ = ctx.ResponseText("second")
+	})
+	client := NewPublicClient(&PublicClientConfigs{
+		Appid:          "wx_test",
+		Dispatcher:     d,
+		MsgVerifyToken: "token",
+		TokenGetter: func() (string, error) {
+			return "access_token", nil
+		},
+		ReplyTimeout: 20 * time.Millisecond,
+		ReplyErrorHandler: func(err *ReplyError) {
+			failed <- err
+		},
+	})
+	client.ListenMessage(httptest.NewRecorder(), newMessageRequest("token", textMessageXML("openid", "slow", 2)))
+	close(release)
+	// 超出回复窗口后剩余消息不再发送, 全部通过 ReplyErrorHandler 报告
+	for _, need := range []string{"first", "second"} {
+		select {
+		case err := <-failed:
+			werr, ok := err.Err.(*pkg.Error)
+			if err.Msg.Content.Value != need || !ok || werr.ErrCode != 45015 || err.Openid != "openid" {
+				t.Errorf("unexpected reply error: %s", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("reply error of %s not reported", need)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package src
+
+import (
+	"fmt"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+)
+
+// 公众号客户端(及 Context)方法所需的权限集 id, 未列出的方法不检查权限集
+var MethodScopes = map[string]int{
+	"SendCustomerMessage": open_platform.FuncScopeMessage, // 包括以客服消息发送的回复
+	"SendMiniProgramPage": open_platform.FuncScopeMessage,
+	"UploadMaterial":      open_platform.FuncScopeMaterial,
+	"UploadTempMaterial":  open_platform.FuncScopeMaterial,
+	"WalkSubscribers":     open_platform.FuncScopeUser,
+	"CreateAppUserTag":    open_platform.FuncScopeUser,
+	"GetAppUserTags":      open_platform.FuncScopeUser,
+	"UpdateAppUserTag":    open_platform.FuncScopeUser,
+	"DeleteAppUserTag":    open_platform.FuncScopeUser,
+	"GetAppTagUsers":      open_platform.FuncScopeUser,
+	"WalkAppTagUsers":     open_platform.FuncScopeUser,
+	"BatchTagging":        open_platform.FuncScopeUser,
+	"WaitBatchTagging":    open_platform.FuncScopeUser,
+	"BatchUntagging":      open_platform.FuncScopeUser,
+	"GetUserTags":         open_platform.FuncScopeUser,
+	"CreateMenu":          open_platform.FuncScopeMenu,
+	"DeleteMenu":          open_platform.FuncScopeMenu,
+}
+
+// 权限集未授权错误
+type ScopeError struct {
+	Appid  string
+	Method string // 调用的方法, 通过 RequireScope 检查时为空
+	Scope  int    // 缺少的权限集 id
+}
+
+func (e *ScopeError) Error() string {
+	if e.Method == "" {
+		return fmt.Sprintf("{appid: %s} func scope %d is not authorized", e.Appid, e.Scope)
+	}
+	return fmt.Sprintf("{appid: %s} func scope %d is not authorized, cannot call %s", e.Appid, e.Scope, e.Method)
+}
+
+// 判断公众号是否授权了权限集, 没有授权信息(如直接管理的公众号)或权限集未知(如旧数据未保存权限集)时视为拥有所有权限集
+func (pc *PublicClient) HasScope(scope int) bool {
+	info := pc.GetAppInfo()
+	if info == nil || len(info.FuncInfo) == 0 {
+		return true
+	}
+	for _, fs := range info.FuncInfo {
+		if fs.FuncscopeCategory.ID == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查公众号是否授权了权限集, 未授权时返回 *ScopeError
+func (pc *PublicClient) RequireScope(scope int) error {
+	if pc.HasScope(scope) {
+		return nil
+	}
+	return &ScopeError{Appid: pc.configs.Appid, Scope: scope}
+}
+
+// 获得调用 method 所需的 token, 开启 CheckScope 时先检查权限集
+func (pc *PublicClient) tokenFor(method string) (string, error) {
+	if pc.configs.CheckScope {
+		if scope, ok := MethodScopes[method]; ok && !pc.HasScope(scope) {
+			return "", &ScopeError{Appid: pc.configs.Appid, Method: method, Scope: scope}
+		}
+	}
+	return pc.configs.TokenGetter()
+}
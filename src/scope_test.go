@@ -0,0 +1,105 @@
+package src
+
+import (
+	"github.com/morgine/wechat_sdk/pkg/message"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMethodScopes(t *testing.T) {
+	client, ctx := reflect.TypeOf(&PublicClient{}), reflect.TypeOf(&Context{})
+	for method := range MethodScopes {
+		_, ok := client.MethodByName(method)
+		if !ok {
+			_, ok = ctx.MethodByName(method)
+		}
+		if !ok {
+			t.Errorf("PublicClient and Context have no method %s", method)
+		}
+	}
+}
+
+func TestCheckScope(t *testing.T) {
+	calls := 0
+	pc := NewPublicClient(&PublicClientConfigs{
+		Appid: "wx_app",
+		Info: &open_platform.AuthorizerInfo{FuncInfo: []*open_platform.FuncScope{
+			{FuncscopeCategory: open_platform.Info{ID: open_platform.FuncScopeMessage}},
+		}},
+		TokenGetter: func() (string, error) {
+			calls++
+			return "token", nil
+		},
+		CheckScope: true,
+	})
+	if !pc.HasScope(open_platform.FuncScopeMessage) || pc.HasScope(open_platform.FuncScopeMenu) {
+		t.Error("unexpected scopes")
+	}
+	if err, ok := pc.RequireScope(open_platform.FuncScopeUser).(*ScopeError); !ok || err.Scope != open_platform.FuncScopeUser {
+		t.Errorf("need *ScopeError, got: %v", err)
+	}
+	err := pc.DeleteMenu()
+	if se, ok := err.(*ScopeError); !ok || se.Method != "DeleteMenu" || se.Scope != open_platform.FuncScopeMenu {
+		t.Errorf("need *ScopeError, got: %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("token should not be requested, calls: %d", calls)
+	}
+	if token, err := pc.tokenFor("SendMiniProgramPage"); err != nil || token != "token" {
+		t.Errorf("need token, got: %q, %v", token, err)
+	}
+
+	// 没有授权信息或权限集为空时视为拥有所有权限集
+	for _, info := range []*open_platform.AuthorizerInfo{nil, {NickName: "no func info"}} {
+		pc = NewPublicClient(&PublicClientConfigs{Appid: "wx_app", Info: info})
+		if err := pc.RequireScope(open_platform.FuncScopeMenu); err != nil {
+			t.Errorf("need nil, got: %v", err)
+		}
+	}
+}
+
+func TestCheckScopeCustomerMessage(t *testing.T) {
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		t.Errorf("unexpected request: %s", r.URL.Path)
+		return map[string]interface{}{"errcode": 0}
+	})
+	failed := make(chan *ReplyError, 1)
+	d := NewDispatcher()
+	d.SubscribeTextMsg(func(msg *message.TextMessage, ctx *Context) {
+		err := ctx.SendCustomerMessage(&message.CustomerMessage{MsgType: message.CustomerMsgTypeText, Text: &message.Text{Content: "hi"}})
+		if se, ok := err.(*ScopeError); !ok || se.Method != "SendCustomerMessage" {
+			t.Errorf("need *ScopeError, got: %v", err)
+		}
+		// 第二条回复以客服消息发送
+		_ = ctx.ResponseText("first")
+		_ = ctx.ResponseText("second")
+	})
+	pc := NewPublicClient(&PublicClientConfigs{
+		Appid:          "wx_app",
+		Dispatcher:     d,
+		MsgVerifyToken: "token",
+		Info: &open_platform.AuthorizerInfo{FuncInfo: []*open_platform.FuncScope{
+			{FuncscopeCategory: open_platform.Info{ID: open_platform.FuncScopeMenu}},
+		}},
+		TokenGetter: func() (string, error) {
+			return "token", nil
+		},
+		CheckScope: true,
+		ReplyErrorHandler: func(err *ReplyError) {
+			failed <- err
+		},
+	})
+	pc.ListenMessage(httptest.NewRecorder(), newMessageRequest("token", textMessageXML("openid", "hi", 1)))
+	select {
+	case err := <-failed:
+		if _, ok := err.Err.(*ScopeError); !ok || err.Msg.Content.Value != "second" {
+			t.Errorf("need *ScopeError, got: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reply error not reported")
+	}
+}
@@ -0,0 +1,64 @@
+package src
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// 默认会话过期时间
+const DefaultSessionTTL = 30 * time.Minute
+
+// 用户会话, 用于保存跨消息的对话状态, 如答题、报名表单、客服流程等
+type Session struct {
+	Step   string            `json:"step"`   // 当前对话步骤, 为空表示未处于对话流程中
+	Values map[string]string `json:"values"` // 会话数据
+}
+
+// 会话存储接口, 会话以 (appid, openid) 区分
+type SessionStorage interface {
+	SaveSession(appid, openid string, session *Session, expiration time.Duration) error
+	GetSession(appid, openid string) (*Session, error) // 获得会话, 如果会话不存在, 则返回 nil
+	DelSession(appid, openid string) error
+}
+
+type sessionStorage struct {
+	client AccessStorage
+}
+
+// 创建基于 AccessStorage 的会话存储器
+func NewSessionStorage(storage AccessStorage) SessionStorage {
+	return &sessionStorage{client: storage}
+}
+
+func (s *sessionStorage) SaveSession(appid, openid string, session *Session, expiration time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(sessionKey(appid, openid), data, expiration)
+}
+
+func (s *sessionStorage) GetSession(appid, openid string) (*Session, error) {
+	data, err := s.client.Get(sessionKey(appid, openid))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	session := &Session{}
+	err = json.Unmarshal(data, session)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// AccessStorage 没有删除接口, 写入空值并尽快过期, 空值视为会话不存在
+func (s *sessionStorage) DelSession(appid, openid string) error {
+	return s.client.Set(sessionKey(appid, openid), nil, time.Second)
+}
+
+func sessionKey(appid, openid string) string {
+	return "session_" + appid + "_" + openid
+}
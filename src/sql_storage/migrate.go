@@ -0,0 +1,66 @@
+package sql_storage
+
+import (
+	"strings"
+)
+
+// 数据表迁移, 按版本顺序执行, 已执行的版本记录在 {prefix}schema_migrations 表中.
+// 新增迁移只能追加到末尾, 不可修改已发布的迁移. MySQL 中 DDL 会隐式提交事务,
+// 因此迁移语句须可重复执行(如 IF NOT EXISTS), 中途失败时重新执行即可继续迁移
+var migrations = [][]string{
+	// 1: 公众号信息, 三方平台数据及公众号 token
+	{
+		`CREATE TABLE IF NOT EXISTS {prefix}apps (
+			component_appid VARCHAR(64) NOT NULL,
+			appid VARCHAR(64) NOT NULL,
+			nickname VARCHAR(255) NOT NULL DEFAULT '',
+			service_type INT NOT NULL DEFAULT 0,
+			verify_type INT NOT NULL DEFAULT 0,
+			principal_name VARCHAR(255) NOT NULL DEFAULT '',
+			info TEXT NOT NULL,
+			updated_at BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (component_appid, appid)
+		)`,
+		`CREATE TABLE IF NOT EXISTS {prefix}component_values (
+			component_appid VARCHAR(64) NOT NULL,
+			name VARCHAR(64) NOT NULL,
+			value TEXT NOT NULL,
+			expired_at BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (component_appid, name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS {prefix}authorizer_tokens (
+			component_appid VARCHAR(64) NOT NULL,
+			appid VARCHAR(64) NOT NULL,
+			access_token VARCHAR(512) NOT NULL DEFAULT '',
+			expire_at BIGINT NOT NULL DEFAULT 0,
+			refresh_token VARCHAR(512) NOT NULL DEFAULT '',
+			PRIMARY KEY (component_appid, appid)
+		)`,
+	},
+}
+
+// 创建或更新数据表
+func (s *Storage) Migrate() error {
+	_, err := s.db.Exec("CREATE TABLE IF NOT EXISTS " + s.table("schema_migrations") + " (version INT NOT NULL PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+	var version int
+	err = s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM " + s.table("schema_migrations")).Scan(&version)
+	if err != nil {
+		return err
+	}
+	for v := version + 1; v <= len(migrations); v++ {
+		for _, stmt := range migrations[v-1] {
+			_, err = s.db.Exec(strings.Replace(stmt, "{prefix}", s.configs.TablePrefix, -1))
+			if err != nil {
+				return err
+			}
+		}
+		_, err = s.db.Exec(s.query("INSERT INTO "+s.table("schema_migrations")+" (version) VALUES (?)"), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
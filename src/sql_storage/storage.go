@@ -0,0 +1,355 @@
+// sql_storage 基于 database/sql 实现 AppStorage 及 ComponentStorage 接口, 支持 MySQL, PostgreSQL 及 SQLite
+package sql_storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"github.com/morgine/wechat_sdk/src"
+	"strconv"
+	"strings"
+)
+
+// 数据库类型
+type Dialect int
+
+const (
+	MySQL Dialect = iota
+	PostgreSQL
+	SQLite
+)
+
+// 数据库存储器, 数据以三方平台 appid 区分, 多个三方平台可共用同一组数据表
+type Storage struct {
+	db      *sql.DB
+	configs *Configs
+}
+
+type Configs struct {
+	Dialect        Dialect
+	ComponentAppid string // 三方平台 appid
+	TablePrefix    string // 数据表前缀
+}
+
+var (
+	_ src.AppStorage         = (*Storage)(nil)
+	_ src.AppidLister        = (*Storage)(nil)
+	_ src.AppSearcher        = (*Storage)(nil)
+	_ src.ComponentStorage   = (*Storage)(nil)
+	_ src.PreAuthCodeStorage = (*Storage)(nil)
+)
+
+// 创建数据库存储器, 使用之前需调用 Migrate 创建或更新数据表
+func NewStorage(db *sql.DB, configs *Configs) *Storage {
+	return &Storage{db: db, configs: configs}
+}
+
+func (s *Storage) table(name string) string {
+	return s.configs.TablePrefix + name
+}
+
+// 将 ? 占位符转换为数据库对应的占位符
+func (s *Storage) query(query string) string {
+	if s.configs.Dialect != PostgreSQL {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// 在事务中执行 fn, fn 返回错误时回滚
+func (s *Storage) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Storage) SaveAppInfo(appid string, app *open_platform.AuthorizerInfo) error {
+	data, err := json.Marshal(app)
+	if err != nil {
+		return err
+	}
+	var serviceType, verifyType int
+	if app.ServiceTypeInfo != nil {
+		serviceType = app.ServiceTypeInfo.ID
+	}
+	if app.VerifyTypeInfo != nil {
+		verifyType = app.VerifyTypeInfo.ID
+	}
+	_, err = s.db.Exec(
+		s.upsertQuery("apps", []string{"component_appid", "appid"}, []string{"nickname", "service_type", "verify_type", "principal_name", "info", "updated_at"}),
+		s.configs.ComponentAppid, appid, app.NickName, serviceType, verifyType, app.PrincipalName, string(data), src.Now().Unix(),
+	)
+	return err
+}
+
+// 生成插入或更新语句, 主键 keys 已存在时更新 columns, 参数顺序为 keys 之后接 columns
+func (s *Storage) upsertQuery(table string, keys, columns []string) string {
+	query := "INSERT INTO " + s.table(table) + " (" + strings.Join(keys, ", ") + ", " + strings.Join(columns, ", ") + ")" +
+		" VALUES (" + placeholders(len(keys)+len(columns)) + ")"
+	updates := make([]string, len(columns))
+	if s.configs.Dialect == MySQL {
+		for i, column := range columns {
+			updates[i] = column + " = VALUES(" + column + ")"
+		}
+		query += " ON DUPLICATE KEY UPDATE "
+	} else {
+		for i, column := range columns {
+			updates[i] = column + " = excluded." + column
+		}
+		query += " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET "
+	}
+	return s.query(query + strings.Join(updates, ", "))
+}
+
+func (s *Storage) GetAppInfo(appid string) (*open_platform.AuthorizerInfo, error) {
+	var data string
+	err := s.db.QueryRow(s.query("SELECT info FROM "+s.table("apps")+" WHERE component_appid = ? AND appid = ?"), s.configs.ComponentAppid, appid).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	app := &open_platform.AuthorizerInfo{}
+	err = json.Unmarshal([]byte(data), app)
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+func (s *Storage) DelAppInfo(appid string) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		return s.delApp(tx, appid)
+	})
+}
+
+// 删除公众号信息及 token
+func (s *Storage) delApp(tx *sql.Tx, appid string) error {
+	for _, table := range []string{"apps", "authorizer_tokens"} {
+		_, err := tx.Exec(s.query("DELETE FROM "+s.table(table)+" WHERE component_appid = ? AND appid = ?"), s.configs.ComponentAppid, appid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 在事务中删除不存在于 appids 中的公众号信息及 token
+func (s *Storage) DelAppInfoNotIn(appids []string) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query(s.query("SELECT appid FROM "+s.table("apps")+" WHERE component_appid = ?"), s.configs.ComponentAppid)
+		if err != nil {
+			return err
+		}
+		keep := make(map[string]bool, len(appids))
+		for _, appid := range appids {
+			keep[appid] = true
+		}
+		var dels []string
+		for rows.Next() {
+			var appid string
+			err = rows.Scan(&appid)
+			if err != nil {
+				_ = rows.Close()
+				return err
+			}
+			if !keep[appid] {
+				dels = append(dels, appid)
+			}
+		}
+		err = rows.Close()
+		if err != nil {
+			return err
+		}
+		for _, appid := range dels {
+			err = s.delApp(tx, appid)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Storage) GetAppids() ([]string, error) {
+	rows, err := s.db.Query(s.query("SELECT appid FROM "+s.table("apps")+" WHERE component_appid = ? ORDER BY appid"), s.configs.ComponentAppid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var appids []string
+	for rows.Next() {
+		var appid string
+		err = rows.Scan(&appid)
+		if err != nil {
+			return nil, err
+		}
+		appids = append(appids, appid)
+	}
+	return appids, rows.Err()
+}
+
+// 查询公众号, 使用 nickname, service_type 及 verify_type 列过滤
+func (s *Storage) SearchApps(query *src.AppQuery) (*src.AppList, error) {
+	where := []string{"component_appid = ?"}
+	args := []interface{}{s.configs.ComponentAppid}
+	if len(query.ServiceTypes) > 0 {
+		where = append(where, "service_type IN ("+placeholders(len(query.ServiceTypes))+")")
+		for _, id := range query.ServiceTypes {
+			args = append(args, id)
+		}
+	}
+	if len(query.VerifyTypes) > 0 {
+		where = append(where, "verify_type IN ("+placeholders(len(query.VerifyTypes))+")")
+		for _, id := range query.VerifyTypes {
+			args = append(args, id)
+		}
+	}
+	if query.Nickname != "" {
+		where = append(where, "LOWER(nickname) LIKE ? ESCAPE '!'")
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(query.Nickname))+"%")
+	}
+	condition := " FROM " + s.table("apps") + " WHERE " + strings.Join(where, " AND ")
+	list := &src.AppList{}
+	err := s.db.QueryRow(s.query("SELECT COUNT(*)"+condition), args...).Scan(&list.Total)
+	if err != nil {
+		return nil, err
+	}
+	selection := "SELECT appid, info" + condition + " ORDER BY appid"
+	offset := query.Offset
+	if query.Limit > 0 {
+		selection += " LIMIT ? OFFSET ?"
+		args = append(args, query.Limit, offset)
+		offset = 0
+	}
+	rows, err := s.db.Query(s.query(selection), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for ; rows.Next(); offset-- {
+		if offset > 0 {
+			continue
+		}
+		var appid, data string
+		err = rows.Scan(&appid, &data)
+		if err != nil {
+			return nil, err
+		}
+		app := &open_platform.AuthorizerInfo{}
+		err = json.Unmarshal([]byte(data), app)
+		if err != nil {
+			return nil, err
+		}
+		list.Apps = append(list.Apps, &src.AppInfo{Appid: appid, AuthorizerInfo: app})
+	}
+	return list, rows.Err()
+}
+
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (s *Storage) SaveVerifyTicket(ticket string) error {
+	return s.saveValue("verify_ticket", ticket, 0)
+}
+
+func (s *Storage) GetVerifyTicket() (string, error) {
+	ticket, _, err := s.getValue("verify_ticket")
+	return ticket, err
+}
+
+func (s *Storage) SaveAccessToken(data *src.ExpireData) error {
+	return s.saveValue("access_token", data.Value, data.ExpiredAt)
+}
+
+// 获得三方平台 access token, token 不存在或已过期时返回 nil
+func (s *Storage) GetAccessToken() (*src.ExpireData, error) {
+	return s.getExpireData("access_token")
+}
+
+func (s *Storage) SavePreAuthCode(data *src.ExpireData) error {
+	return s.saveValue("pre_auth_code", data.Value, data.ExpiredAt)
+}
+
+// 获得预授权码, 预授权码不存在或已过期时返回 nil
+func (s *Storage) GetPreAuthCode() (*src.ExpireData, error) {
+	return s.getExpireData("pre_auth_code")
+}
+
+func (s *Storage) getExpireData(name string) (*src.ExpireData, error) {
+	value, expiredAt, err := s.getValue(name)
+	if err != nil {
+		return nil, err
+	}
+	if value == "" || (expiredAt > 0 && expiredAt < src.Now().Unix()) {
+		return nil, nil
+	}
+	return &src.ExpireData{Value: value, ExpiredAt: expiredAt}, nil
+}
+
+func (s *Storage) saveValue(name, value string, expiredAt int64) error {
+	_, err := s.db.Exec(
+		s.upsertQuery("component_values", []string{"component_appid", "name"}, []string{"value", "expired_at"}),
+		s.configs.ComponentAppid, name, value, expiredAt,
+	)
+	return err
+}
+
+// 获得三方平台数据, 数据不存在时返回空字符串
+func (s *Storage) getValue(name string) (value string, expiredAt int64, err error) {
+	err = s.db.QueryRow(
+		s.query("SELECT value, expired_at FROM "+s.table("component_values")+" WHERE component_appid = ? AND name = ?"),
+		s.configs.ComponentAppid, name,
+	).Scan(&value, &expiredAt)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	return value, expiredAt, err
+}
+
+func (s *Storage) SaveAppAccessToken(appid string, token *src.AppAccessToken) error {
+	_, err := s.db.Exec(
+		s.upsertQuery("authorizer_tokens", []string{"component_appid", "appid"}, []string{"access_token", "expire_at", "refresh_token"}),
+		s.configs.ComponentAppid, appid, token.AccessToken, token.ExpireAt, token.RefreshToken,
+	)
+	return err
+}
+
+func (s *Storage) GetAppAccessToken(appid string) (*src.AppAccessToken, error) {
+	token := &src.AppAccessToken{}
+	err := s.db.QueryRow(
+		s.query("SELECT access_token, expire_at, refresh_token FROM "+s.table("authorizer_tokens")+" WHERE component_appid = ? AND appid = ?"),
+		s.configs.ComponentAppid, appid,
+	).Scan(&token.AccessToken, &token.ExpireAt, &token.RefreshToken)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" {
+		return nil, nil
+	}
+	return token, nil
+}
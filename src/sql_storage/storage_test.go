@@ -0,0 +1,210 @@
+package sql_storage
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"github.com/morgine/wechat_sdk/src"
+	"github.com/morgine/wechat_sdk/src/storagetest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestStorage(t *testing.T, componentAppid string, db *sql.DB) *Storage {
+	if db == nil {
+		var err error
+		db, err = sql.Open("sqlite3", filepath.Join(t.TempDir(), "wechat.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+	}
+	s := NewStorage(db, &Configs{Dialect: SQLite, ComponentAppid: componentAppid, TablePrefix: "wx_"})
+	// 重复迁移不应出错
+	for i := 0; i < 2; i++ {
+		if err := s.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestAppStorage(t *testing.T) {
+	s := newTestStorage(t, "component", nil)
+	other := newTestStorage(t, "other_component", s.db)
+	if app, err := s.GetAppInfo("wx_missing"); err != nil || app != nil {
+		t.Fatalf("need nil app, got: %+v, %v", app, err)
+	}
+	for _, appid := range []string{"wx_a", "wx_b", "wx_c"} {
+		err := s.SaveAppInfo(appid, &open_platform.AuthorizerInfo{
+			NickName:        "nick_" + appid,
+			ServiceTypeInfo: &open_platform.Info{ID: 2},
+			VerifyTypeInfo:  &open_platform.Info{ID: -1},
+			PrincipalName:   "principal",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := other.SaveAppInfo("wx_b", &open_platform.AuthorizerInfo{NickName: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	// 重复保存将覆盖
+	if err := s.SaveAppInfo("wx_a", &open_platform.AuthorizerInfo{NickName: "renamed", ServiceTypeInfo: &open_platform.Info{ID: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	app, err := s.GetAppInfo("wx_a")
+	if err != nil || app == nil || app.NickName != "renamed" {
+		t.Fatalf("unexpected app: %+v, %v", app, err)
+	}
+	var nickname string
+	var serviceType, verifyType int
+	err = s.db.QueryRow("SELECT nickname, service_type, verify_type FROM wx_apps WHERE appid = 'wx_c'").Scan(&nickname, &serviceType, &verifyType)
+	if err != nil || nickname != "nick_wx_c" || serviceType != 2 || verifyType != -1 {
+		t.Errorf("unexpected columns: %s, %d, %d, %v", nickname, serviceType, verifyType, err)
+	}
+
+	for _, appid := range []string{"wx_a", "wx_b", "wx_c"} {
+		if err = s.SaveAppAccessToken(appid, &src.AppAccessToken{AccessToken: "token_" + appid, RefreshToken: "refresh"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.DelAppInfoNotIn([]string{"wx_a", "wx_c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DelAppInfo("wx_c"); err != nil {
+		t.Fatal(err)
+	}
+	appids, err := s.GetAppids()
+	if err != nil || len(appids) != 1 || appids[0] != "wx_a" {
+		t.Errorf("need [wx_a], got: %v, %v", appids, err)
+	}
+	// 删除公众号时同时删除 token
+	for appid, exists := range map[string]bool{"wx_a": true, "wx_b": false, "wx_c": false} {
+		if token, err := s.GetAppAccessToken(appid); err != nil || (token != nil) != exists {
+			t.Errorf("%s: unexpected token: %+v, %v", appid, token, err)
+		}
+	}
+	// 其他三方平台的数据不受影响
+	if app, err = other.GetAppInfo("wx_b"); err != nil || app == nil || app.NickName != "other" {
+		t.Errorf("unexpected other app: %+v, %v", app, err)
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	s := newTestStorage(t, "component", nil)
+	// 模拟迁移语句已执行但版本未记录(如 MySQL 中 DDL 已提交后失败)
+	if _, err := s.db.Exec("DELETE FROM wx_schema_migrations"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	if err := s.db.QueryRow("SELECT MAX(version) FROM wx_schema_migrations").Scan(&version); err != nil || version != len(migrations) {
+		t.Errorf("need version %d, got: %d, %v", len(migrations), version, err)
+	}
+}
+
+func TestComponentStorage(t *testing.T) {
+	s := newTestStorage(t, "component", nil)
+	if ticket, err := s.GetVerifyTicket(); err != nil || ticket != "" {
+		t.Fatalf("need empty ticket, got: %q, %v", ticket, err)
+	}
+	if err := s.SaveVerifyTicket("ticket"); err != nil {
+		t.Fatal(err)
+	}
+	if ticket, err := s.GetVerifyTicket(); err != nil || ticket != "ticket" {
+		t.Errorf("need ticket, got: %q, %v", ticket, err)
+	}
+	if token, err := s.GetAccessToken(); err != nil || token != nil {
+		t.Fatalf("need nil token, got: %+v, %v", token, err)
+	}
+	if err := s.SaveAccessToken(&src.ExpireData{Value: "expired", ExpiredAt: time.Now().Add(-time.Second).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := s.GetAccessToken(); err != nil || token != nil {
+		t.Errorf("need expired token, got: %+v, %v", token, err)
+	}
+	if token, err := s.GetAppAccessToken("wx_app"); err != nil || token != nil {
+		t.Fatalf("need nil app token, got: %+v, %v", token, err)
+	}
+	err := s.SaveAppAccessToken("wx_app", &src.AppAccessToken{AccessToken: "app_token", ExpireAt: 100, RefreshToken: "refresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.GetAppAccessToken("wx_app")
+	if err != nil || token == nil || token.AccessToken != "app_token" || token.ExpireAt != 100 || token.RefreshToken != "refresh" {
+		t.Errorf("unexpected app token: %+v, %v", token, err)
+	}
+}
+
+func TestPostgreSQLPlaceholder(t *testing.T) {
+	s := NewStorage(nil, &Configs{Dialect: PostgreSQL})
+	if got, need := s.query("a = ? AND b = ?"), "a = $1 AND b = $2"; got != need {
+		t.Errorf("need: %s, got: %s", need, got)
+	}
+}
+
+func TestUpsertQuery(t *testing.T) {
+	keys, columns := []string{"component_appid", "name"}, []string{"value", "expired_at"}
+	for dialect, need := range map[Dialect]string{
+		MySQL:      "INSERT INTO wx_values (component_appid, name, value, expired_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value), expired_at = VALUES(expired_at)",
+		PostgreSQL: "INSERT INTO wx_values (component_appid, name, value, expired_at) VALUES ($1, $2, $3, $4) ON CONFLICT (component_appid, name) DO UPDATE SET value = excluded.value, expired_at = excluded.expired_at",
+		SQLite:     "INSERT INTO wx_values (component_appid, name, value, expired_at) VALUES (?, ?, ?, ?) ON CONFLICT (component_appid, name) DO UPDATE SET value = excluded.value, expired_at = excluded.expired_at",
+	} {
+		s := NewStorage(nil, &Configs{Dialect: dialect, TablePrefix: "wx_"})
+		if got := s.upsertQuery("values", keys, columns); got != need {
+			t.Errorf("%d: need: %s, got: %s", dialect, need, got)
+		}
+	}
+}
+
+func TestConcurrentSave(t *testing.T) {
+	s := newTestStorage(t, "component", nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value := fmt.Sprint("value_", i)
+			if err := s.SaveAppInfo("wx_app", &open_platform.AuthorizerInfo{NickName: value}); err != nil {
+				t.Error(err)
+			}
+			if err := s.SaveAccessToken(&src.ExpireData{Value: value}); err != nil {
+				t.Error(err)
+			}
+			if err := s.SaveAppAccessToken("wx_app", &src.AppAccessToken{AccessToken: value, RefreshToken: value}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, table := range []string{"wx_apps", "wx_component_values", "wx_authorizer_tokens"} {
+		var count int
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil || count != 1 {
+			t.Errorf("%s: need 1 row, got: %d, %v", table, count, err)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	now, offset := src.Now, time.Duration(0)
+	src.Now = func() time.Time {
+		return now().Add(offset)
+	}
+	defer func() {
+		src.Now = now
+	}()
+	opts := &storagetest.Options{Advance: func(d time.Duration) {
+		offset += d
+	}}
+	storagetest.TestAppStorage(t, func() src.AppStorage { return newTestStorage(t, "component", nil) }, opts)
+	storagetest.TestComponentStorage(t, func() src.ComponentStorage { return newTestStorage(t, "component", nil) }, opts)
+}
@@ -12,12 +12,16 @@ type ComponentStorage interface {
 	GetVerifyTicket() (string, error) // 获得 ticket, 如果 ticket 不存在，则返回空字符串
 	SaveAccessToken(data *ExpireData) error
 	GetAccessToken() (*ExpireData, error) // 获得 access token, 如果 token 不存在，则返回 nil
-	//SavePreAuthCode(data *ExpireData) error
-	//GetPreAuthCode() (*ExpireData, error) // 获得 pre auth code, 如果 code 不存在，则返回 nil
 	SaveAppAccessToken(appid string, token *AppAccessToken) error
 	GetAppAccessToken(appid string) (*AppAccessToken, error) // 获得公众号 token, 如果 token 不存在，则返回 nil
 }
 
+// 可选接口, ComponentStorage 实现该接口时缓存预授权码, 否则每次生成授权地址都将重新获取预授权码
+type PreAuthCodeStorage interface {
+	SavePreAuthCode(data *ExpireData) error
+	GetPreAuthCode() (*ExpireData, error) // 获得 pre auth code, 如果 code 不存在，则返回 nil
+}
+
 type AccessStorage interface {
 	Set(key string, value []byte, expiration time.Duration) error
 	Get(key string) (value []byte, err error)
@@ -61,7 +65,7 @@ func (c *componentStorage) GetVerifyTicket() (string, error) {
 }
 
 func (c *componentStorage) SaveAccessToken(data *ExpireData) error {
-	return c.marshalJSON("access_token", data, time.Unix(data.ExpiredAt, 0).Sub(time.Now()))
+	return c.marshalJSON("access_token", data, time.Unix(data.ExpiredAt, 0).Sub(Now()))
 }
 
 func (c *componentStorage) GetAccessToken() (*ExpireData, error) {
@@ -77,22 +81,22 @@ func (c *componentStorage) GetAccessToken() (*ExpireData, error) {
 	}
 }
 
-//func (c *componentStorage) SavePreAuthCode(data *ExpireData) error {
-//	return c.marshalJSON("pre_auth_code", data, time.Unix(data.ExpiredAt, 0).Sub(time.Now()))
-//}
-//
-//func (c *componentStorage) GetPreAuthCode() (*ExpireData, error) {
-//	data := &ExpireData{}
-//	err := c.unmarshalJSON("pre_auth_code", data)
-//	if err != nil {
-//		return nil, err
-//	}
-//	if data.Value != "" {
-//		return data, nil
-//	} else {
-//		return nil, nil
-//	}
-//}
+func (c *componentStorage) SavePreAuthCode(data *ExpireData) error {
+	return c.marshalJSON("pre_auth_code", data, time.Unix(data.ExpiredAt, 0).Sub(Now()))
+}
+
+func (c *componentStorage) GetPreAuthCode() (*ExpireData, error) {
+	data := &ExpireData{}
+	err := c.unmarshalJSON("pre_auth_code", data)
+	if err != nil {
+		return nil, err
+	}
+	if data.Value != "" {
+		return data, nil
+	} else {
+		return nil, nil
+	}
+}
 
 func (c *componentStorage) SaveAppAccessToken(appid string, token *AppAccessToken) error {
 	return c.marshalJSON("app_access_token_"+appid, token, 0)
@@ -0,0 +1,64 @@
+package src_test
+
+import (
+	"github.com/morgine/wechat_sdk/src"
+	"github.com/morgine/wechat_sdk/src/storagetest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 通过修改 src.Now 使时间前进, 测试结束后恢复
+func advanceNow(t *testing.T) *storagetest.Options {
+	now, offset := src.Now, time.Duration(0)
+	src.Now = func() time.Time {
+		return now().Add(offset)
+	}
+	t.Cleanup(func() {
+		src.Now = now
+	})
+	return &storagetest.Options{Advance: func(d time.Duration) {
+		offset += d
+	}}
+}
+
+func newFileStorage(t *testing.T) *src.FileStorage {
+	fs, err := src.NewFileStorage(filepath.Join(t.TempDir(), "wechat.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	opts := advanceNow(t)
+	storagetest.TestAccessStorage(t, func() src.AccessStorage { return src.NewMemoryStorage() }, opts)
+	storagetest.TestAppStorage(t, func() src.AppStorage { return src.NewMemoryStorage() }, opts)
+	storagetest.TestComponentStorage(t, func() src.ComponentStorage {
+		return src.NewComponentStorage("component", src.NewMemoryStorage())
+	}, opts)
+}
+
+func TestFileStorageConformance(t *testing.T) {
+	opts := advanceNow(t)
+	storagetest.TestAccessStorage(t, func() src.AccessStorage { return newFileStorage(t) }, opts)
+	storagetest.TestAppStorage(t, func() src.AppStorage { return newFileStorage(t) }, opts)
+	storagetest.TestComponentStorage(t, func() src.ComponentStorage {
+		return src.NewComponentStorage("component", newFileStorage(t))
+	}, opts)
+}
+
+func TestEncryptedStorageConformance(t *testing.T) {
+	keys, err := src.NewStaticKeyProvider("key", map[string][]byte{"key": []byte("0123456789abcdef")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs := &src.EncryptionConfigs{Keys: keys}
+	opts := advanceNow(t)
+	storagetest.TestAccessStorage(t, func() src.AccessStorage {
+		return src.NewEncryptedStorage(src.NewMemoryStorage(), configs)
+	}, opts)
+	storagetest.TestComponentStorage(t, func() src.ComponentStorage {
+		return src.NewEncryptedComponentStorage(src.NewComponentStorage("component", src.NewMemoryStorage()), configs)
+	}, opts)
+}
@@ -0,0 +1,386 @@
+// storagetest 用于验证 AccessStorage, ComponentStorage 及 AppStorage 的实现是否满足 SDK 的约定:
+//
+//   - 数据不存在时: AccessStorage.Get 返回 nil, GetVerifyTicket 返回空字符串, GetAccessToken,
+//     GetAppAccessToken 及 GetAppInfo 返回 nil, 且均不返回错误
+//   - AccessStorage.Set 的 expiration 为 0 时永不过期, 大于 0 时到期后不可读取
+//   - ComponentStorage 的 access token 在 ExpireData.ExpiredAt 之后不可读取
+//   - DelAppInfoNotIn 只保留 appids 中的公众号, appids 中不存在的公众号不会报错
+//   - 所有方法可并发调用
+//
+// 使用方式:
+//
+//	func TestStorage(t *testing.T) {
+//		storagetest.TestAppStorage(t, func() src.AppStorage { return newStorage() }, nil)
+//	}
+package storagetest
+
+import (
+	"fmt"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"github.com/morgine/wechat_sdk/src"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Options struct {
+	// 使存储器的时间前进 d, 用于测试过期. 为 nil 时使用 time.Sleep 等待.
+	// 基于 src.Now 判断过期的实现可修改 src.Now, redis 等外部存储可使用其提供的时间控制方法
+	Advance func(d time.Duration)
+}
+
+func (opts *Options) advance(d time.Duration) {
+	if opts != nil && opts.Advance != nil {
+		opts.Advance(d)
+	} else {
+		time.Sleep(d)
+	}
+}
+
+// 过期测试使用的过期时间, redis 等存储的过期时间精度为秒
+const expiration = 2 * time.Second
+
+const concurrency = 20
+
+// 测试 AccessStorage, newStorage 每次调用都应返回一个空的存储器
+func TestAccessStorage(t *testing.T, newStorage func() src.AccessStorage, opts *Options) {
+	t.Run("Missing", func(t *testing.T) {
+		s := newStorage()
+		value, err := s.Get("missing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(value) != 0 {
+			t.Errorf("missing key: need empty value, got: %q", value)
+		}
+	})
+	t.Run("SetGet", func(t *testing.T) {
+		s := newStorage()
+		for _, value := range []string{"first", "second"} {
+			if err := s.Set("key", []byte(value), 0); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.Get("key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != value {
+				t.Errorf("need: %q, got: %q", value, got)
+			}
+		}
+	})
+	t.Run("Expiration", func(t *testing.T) {
+		s := newStorage()
+		if err := s.Set("forever", []byte("value"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set("expire", []byte("value"), expiration); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.Get("expire"); err != nil || string(got) != "value" {
+			t.Fatalf("value should not expire yet, got: %q, %v", got, err)
+		}
+		opts.advance(expiration + time.Second)
+		if got, err := s.Get("expire"); err != nil || len(got) != 0 {
+			t.Errorf("value should expire, got: %q, %v", got, err)
+		}
+		if got, err := s.Get("forever"); err != nil || string(got) != "value" {
+			t.Errorf("value with 0 expiration should not expire, got: %q, %v", got, err)
+		}
+	})
+	t.Run("Concurrency", func(t *testing.T) {
+		s := newStorage()
+		parallel(t, func(i int) error {
+			key, value := fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", i)
+			if err := s.Set(key, []byte(value), 0); err != nil {
+				return err
+			}
+			got, err := s.Get(key)
+			if err != nil {
+				return err
+			}
+			if string(got) != value {
+				return fmt.Errorf("need: %q, got: %q", value, got)
+			}
+			return nil
+		})
+	})
+}
+
+// 测试 ComponentStorage, newStorage 每次调用都应返回一个空的存储器
+func TestComponentStorage(t *testing.T, newStorage func() src.ComponentStorage, opts *Options) {
+	t.Run("Missing", func(t *testing.T) {
+		s := newStorage()
+		if ticket, err := s.GetVerifyTicket(); err != nil || ticket != "" {
+			t.Errorf("missing ticket: need empty string, got: %q, %v", ticket, err)
+		}
+		if token, err := s.GetAccessToken(); err != nil || token != nil {
+			t.Errorf("missing access token: need nil, got: %+v, %v", token, err)
+		}
+		if token, err := s.GetAppAccessToken("wx_missing"); err != nil || token != nil {
+			t.Errorf("missing app access token: need nil, got: %+v, %v", token, err)
+		}
+	})
+	t.Run("VerifyTicket", func(t *testing.T) {
+		s := newStorage()
+		for _, ticket := range []string{"first", "second"} {
+			if err := s.SaveVerifyTicket(ticket); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.GetVerifyTicket(); err != nil || got != ticket {
+				t.Errorf("need: %q, got: %q, %v", ticket, got, err)
+			}
+		}
+	})
+	t.Run("AccessTokenExpiration", func(t *testing.T) {
+		s := newStorage()
+		data := &src.ExpireData{Value: "token", ExpiredAt: src.Now().Add(expiration).Unix()}
+		if err := s.SaveAccessToken(data); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetAccessToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.Value != data.Value || got.ExpiredAt != data.ExpiredAt {
+			t.Fatalf("need: %+v, got: %+v", data, got)
+		}
+		opts.advance(expiration + time.Second)
+		if got, err = s.GetAccessToken(); err != nil || got != nil {
+			t.Errorf("access token should expire at ExpiredAt, got: %+v, %v", got, err)
+		}
+	})
+	t.Run("PreAuthCode", func(t *testing.T) {
+		s, ok := newStorage().(src.PreAuthCodeStorage)
+		if !ok {
+			t.Skip("storage does not implement src.PreAuthCodeStorage")
+		}
+		if code, err := s.GetPreAuthCode(); err != nil || code != nil {
+			t.Errorf("missing pre auth code: need nil, got: %+v, %v", code, err)
+		}
+		data := &src.ExpireData{Value: "code", ExpiredAt: src.Now().Add(expiration).Unix()}
+		if err := s.SavePreAuthCode(data); err != nil {
+			t.Fatal(err)
+		}
+		if code, err := s.GetPreAuthCode(); err != nil || code == nil || *code != *data {
+			t.Fatalf("need: %+v, got: %+v, %v", data, code, err)
+		}
+		opts.advance(expiration + time.Second)
+		if code, err := s.GetPreAuthCode(); err != nil || code != nil {
+			t.Errorf("pre auth code should expire at ExpiredAt, got: %+v, %v", code, err)
+		}
+	})
+	t.Run("AppAccessToken", func(t *testing.T) {
+		s := newStorage()
+		token := &src.AppAccessToken{AccessToken: "token", ExpireAt: src.Now().Add(expiration).Unix(), RefreshToken: "refresh"}
+		if err := s.SaveAppAccessToken("wx_app", token); err != nil {
+			t.Fatal(err)
+		}
+		// 公众号 token 的 refresh token 没有过期时间, 过期的 access token 需要通过 refresh token 刷新
+		opts.advance(expiration + time.Second)
+		got, err := s.GetAppAccessToken("wx_app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || *got != *token {
+			t.Errorf("need: %+v, got: %+v", token, got)
+		}
+		if got, err = s.GetAppAccessToken("wx_other"); err != nil || got != nil {
+			t.Errorf("other app: need nil, got: %+v, %v", got, err)
+		}
+	})
+	t.Run("Concurrency", func(t *testing.T) {
+		s := newStorage()
+		parallel(t, func(i int) error {
+			appid := fmt.Sprintf("wx_%d", i)
+			token := &src.AppAccessToken{AccessToken: "token_" + appid, RefreshToken: "refresh_" + appid}
+			if err := s.SaveAppAccessToken(appid, token); err != nil {
+				return err
+			}
+			got, err := s.GetAppAccessToken(appid)
+			if err != nil {
+				return err
+			}
+			if got == nil || *got != *token {
+				return fmt.Errorf("need: %+v, got: %+v", token, got)
+			}
+			return nil
+		})
+	})
+}
+
+// 测试 AppStorage, newStorage 每次调用都应返回一个空的存储器. 如果存储器实现了 src.AppidLister 或 src.AppSearcher, 将同时测试 GetAppids 及 SearchApps
+func TestAppStorage(t *testing.T, newStorage func() src.AppStorage, opts *Options) {
+	t.Run("Missing", func(t *testing.T) {
+		s := newStorage()
+		if app, err := s.GetAppInfo("wx_missing"); err != nil || app != nil {
+			t.Errorf("missing app: need nil, got: %+v, %v", app, err)
+		}
+		if err := s.DelAppInfo("wx_missing"); err != nil {
+			t.Errorf("delete missing app: %v", err)
+		}
+	})
+	t.Run("SaveGet", func(t *testing.T) {
+		s := newStorage()
+		app := newApp("wx_app")
+		if err := s.SaveAppInfo("wx_app", app); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetAppInfo("wx_app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.NickName != app.NickName || got.PrincipalName != app.PrincipalName ||
+			got.ServiceTypeInfo == nil || got.ServiceTypeInfo.ID != app.ServiceTypeInfo.ID ||
+			got.VerifyTypeInfo == nil || got.VerifyTypeInfo.ID != app.VerifyTypeInfo.ID ||
+			len(got.FuncInfo) != 1 || got.FuncInfo[0].FuncscopeCategory.ID != 1 {
+			t.Errorf("need: %+v, got: %+v", app, got)
+		}
+		app.NickName = "renamed"
+		if err = s.SaveAppInfo("wx_app", app); err != nil {
+			t.Fatal(err)
+		}
+		if got, err = s.GetAppInfo("wx_app"); err != nil || got == nil || got.NickName != "renamed" {
+			t.Errorf("app should be overwritten, got: %+v, %v", got, err)
+		}
+		if err = s.DelAppInfo("wx_app"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err = s.GetAppInfo("wx_app"); err != nil || got != nil {
+			t.Errorf("app should be deleted, got: %+v, %v", got, err)
+		}
+	})
+	t.Run("DelAppInfoNotIn", func(t *testing.T) {
+		s := newStorage()
+		for _, appid := range []string{"wx_a", "wx_b", "wx_c"} {
+			if err := s.SaveAppInfo(appid, newApp(appid)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.DelAppInfoNotIn([]string{"wx_a", "wx_c", "wx_missing"}); err != nil {
+			t.Fatal(err)
+		}
+		checkApps(t, s, []string{"wx_a", "wx_c"}, []string{"wx_b", "wx_missing"})
+		if err := s.DelAppInfoNotIn(nil); err != nil {
+			t.Fatal(err)
+		}
+		checkApps(t, s, nil, []string{"wx_a", "wx_c"})
+	})
+	t.Run("Search", func(t *testing.T) {
+		s := newStorage()
+		searcher, ok := s.(src.AppSearcher)
+		if !ok {
+			t.Skip("storage does not implement src.AppSearcher")
+		}
+		apps := map[string]*open_platform.AuthorizerInfo{
+			"wx_a": {NickName: "Foo_Bar", ServiceTypeInfo: &open_platform.Info{ID: 2}, VerifyTypeInfo: &open_platform.Info{ID: 0}},
+			"wx_b": {NickName: "foo%", ServiceTypeInfo: &open_platform.Info{ID: 0}, VerifyTypeInfo: &open_platform.Info{ID: -1}},
+			"wx_c": {NickName: "other", ServiceTypeInfo: &open_platform.Info{ID: 2}, VerifyTypeInfo: &open_platform.Info{ID: -1}},
+		}
+		for appid, app := range apps {
+			if err := s.SaveAppInfo(appid, app); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, c := range []struct {
+			query *src.AppQuery
+			total int
+			need  string
+		}{
+			{&src.AppQuery{}, 3, "[wx_a wx_b wx_c]"},
+			{&src.AppQuery{Offset: 1, Limit: 1}, 3, "[wx_b]"},
+			{&src.AppQuery{Offset: 2}, 3, "[wx_c]"},
+			{&src.AppQuery{ServiceTypes: []int{2}}, 2, "[wx_a wx_c]"},
+			{&src.AppQuery{ServiceTypes: []int{2}, VerifyTypes: []int{-1}}, 1, "[wx_c]"},
+			{&src.AppQuery{Nickname: "FOO"}, 2, "[wx_a wx_b]"},
+			{&src.AppQuery{Nickname: "o%"}, 1, "[wx_b]"},
+			{&src.AppQuery{Nickname: "o_b"}, 1, "[wx_a]"},
+		} {
+			list, err := searcher.SearchApps(c.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var appids []string
+			for _, app := range list.Apps {
+				appids = append(appids, app.Appid)
+				if app.NickName != apps[app.Appid].NickName {
+					t.Errorf("%s: need nickname %q, got: %q", app.Appid, apps[app.Appid].NickName, app.NickName)
+				}
+			}
+			if list.Total != c.total || fmt.Sprint(appids) != c.need {
+				t.Errorf("query %+v: need: %d %s, got: %d %v", c.query, c.total, c.need, list.Total, appids)
+			}
+		}
+	})
+	t.Run("Concurrency", func(t *testing.T) {
+		s := newStorage()
+		var appids []string
+		for i := 0; i < concurrency; i++ {
+			appids = append(appids, fmt.Sprintf("wx_%02d", i))
+		}
+		parallel(t, func(i int) error {
+			return s.SaveAppInfo(appids[i], newApp(appids[i]))
+		})
+		checkApps(t, s, appids, nil)
+	})
+}
+
+func newApp(appid string) *open_platform.AuthorizerInfo {
+	return &open_platform.AuthorizerInfo{
+		NickName:        "nick_" + appid,
+		ServiceTypeInfo: &open_platform.Info{ID: 2},
+		VerifyTypeInfo:  &open_platform.Info{ID: 0},
+		UserName:        "gh_" + appid,
+		PrincipalName:   "principal_" + appid,
+		FuncInfo:        []*open_platform.FuncScope{{FuncscopeCategory: open_platform.Info{ID: 1}}},
+	}
+}
+
+// 检查 exists 中的公众号存在, missing 中的公众号不存在
+func checkApps(t *testing.T, s src.AppStorage, exists, missing []string) {
+	t.Helper()
+	for _, appid := range exists {
+		if app, err := s.GetAppInfo(appid); err != nil || app == nil {
+			t.Errorf("%s should exist, got: %+v, %v", appid, app, err)
+		}
+	}
+	for _, appid := range missing {
+		if app, err := s.GetAppInfo(appid); err != nil || app != nil {
+			t.Errorf("%s should not exist, got: %+v, %v", appid, app, err)
+		}
+	}
+	if lister, ok := s.(src.AppidLister); ok {
+		appids, err := lister.GetAppids()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(appids)
+		need := append([]string(nil), exists...)
+		sort.Strings(need)
+		if fmt.Sprint(appids) != fmt.Sprint(need) {
+			t.Errorf("GetAppids: need: %v, got: %v", need, appids)
+		}
+	}
+}
+
+// 并发执行 fn
+func parallel(t *testing.T, fn func(i int) error) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := fn(i); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
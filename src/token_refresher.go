@@ -0,0 +1,150 @@
+package src
+
+import (
+	"github.com/morgine/wechat_sdk/pkg"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 可选接口, AppStorage 实现该接口时可列出所有已保存的公众号 appid,
+// 否则将通过开放平台接口拉取已授权的公众号列表
+type AppidLister interface {
+	GetAppids() ([]string, error)
+}
+
+// token 主动刷新配置
+type TokenRefresherOptions struct {
+	Interval    time.Duration                    // 检查间隔, 为 0 时默认 10 分钟
+	Ahead       time.Duration                    // token 剩余有效期小于该值时刷新, 为 0 时默认 20 分钟, 应大于 Interval
+	Concurrency int                              // 最大并发刷新数, 为 0 时默认 10
+	Jitter      time.Duration                    // 每次刷新之前的随机延迟上限, 用于分散请求, 为 0 时不延迟
+	OnReport    func(report *TokenRefreshReport) // 每轮刷新结束之后调用
+}
+
+// token 刷新报告
+type TokenRefreshReport struct {
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	ComponentErr error            // 三方平台 token 刷新错误, 不为 nil 时不会刷新公众号 token
+	Total        int              // 检查的公众号数量
+	Invalid      []string         // refresh token 已失效或已取消授权的公众号, 需要重新授权
+	Errors       map[string]error // 其他刷新失败的公众号
+}
+
+func (opts *TokenRefresherOptions) init() {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Minute
+	}
+	if opts.Ahead <= 0 {
+		opts.Ahead = 20 * time.Minute
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 10
+	}
+}
+
+// 启动后台 token 刷新, 立即执行一次, 之后定时刷新三方平台及所有公众号即将过期的 token, 返回停止函数
+func (oc *OpenClient) StartTokenRefresher(opts TokenRefresherOptions) (stop func()) {
+	opts.init()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			report := oc.RefreshTokens(opts)
+			if opts.OnReport != nil {
+				opts.OnReport(report)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// 刷新三方平台及所有公众号即将过期的 token
+func (oc *OpenClient) RefreshTokens(opts TokenRefresherOptions) *TokenRefreshReport {
+	opts.init()
+	report := &TokenRefreshReport{
+		StartedAt: Now(),
+		Errors:    map[string]error{},
+	}
+	defer func() {
+		report.FinishedAt = Now()
+	}()
+	_, report.ComponentErr = oc.getComponentAccessTokenBefore(opts.Ahead)
+	if report.ComponentErr != nil {
+		return report
+	}
+	appids, err := oc.getAppids()
+	if err != nil {
+		report.ComponentErr = err
+		return report
+	}
+	report.Total = len(appids)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Concurrency)
+	for _, appid := range appids {
+		wg.Add(1)
+		go func(appid string) {
+			defer wg.Done()
+			// 延迟期间不占用并发数
+			if opts.Jitter > 0 {
+				time.Sleep(time.Duration(rand.Int63n(int64(opts.Jitter))))
+			}
+			sem <- struct{}{}
+			defer func() {
+				<-sem
+			}()
+			_, err := oc.getAppAccessTokenBefore(appid, opts.Ahead)
+			if err != nil {
+				mu.Lock()
+				if isInvalidRefreshToken(err) {
+					report.Invalid = append(report.Invalid, appid)
+				} else {
+					report.Errors[appid] = err
+				}
+				mu.Unlock()
+			}
+		}(appid)
+	}
+	wg.Wait()
+	return report
+}
+
+// 获得所有公众号 appid
+func (oc *OpenClient) getAppids() ([]string, error) {
+	if lister, ok := oc.configs.AppStorage.(AppidLister); ok {
+		return lister.GetAppids()
+	}
+	authorizers, err := oc.getAuthorizers()
+	if err != nil {
+		return nil, err
+	}
+	appids := make([]string, 0, len(authorizers))
+	for _, information := range authorizers {
+		appids = append(appids, information.AuthorizerAppid)
+	}
+	return appids, nil
+}
+
+// refresh token 是否已失效, 61023: refresh_token is invalid, 61003: component is not authorized by this account
+func isInvalidRefreshToken(err error) bool {
+	if werr, ok := err.(*pkg.Error); ok {
+		switch werr.ErrCode {
+		case 61023, 61003:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/morgine/wechat_sdk/pkg/open_platform"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 模拟刷新公众号 token 接口, 根据 appid 返回错误
+func mockAuthorizerToken(t *testing.T, appids []string, running, maxRunning *int32) {
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		data := map[string]string{}
+		_ = json.Unmarshal(body, &data)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/api_get_authorizer_list"):
+			return authorizerListResponse(appids, body)
+		case strings.HasSuffix(r.URL.Path, "/api_authorizer_token"):
+			n := atomic.AddInt32(running, 1)
+			defer atomic.AddInt32(running, -1)
+			for {
+				m := atomic.LoadInt32(maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			switch appid := data["authorizer_appid"]; appid {
+			case "wx_invalid":
+				return map[string]interface{}{"errcode": 61023, "errmsg": "refresh_token is invalid"}
+			case "wx_unauthorized":
+				return map[string]interface{}{"errcode": 61003, "errmsg": "component is not authorized by this account"}
+			case "wx_busy":
+				return map[string]interface{}{"errcode": -1, "errmsg": "system error"}
+			default:
+				return map[string]interface{}{
+					"authorizer_access_token":  "token_" + appid,
+					"expires_in":               7200,
+					"authorizer_refresh_token": data["authorizer_refresh_token"],
+				}
+			}
+		}
+		return map[string]interface{}{"errcode": 40001, "errmsg": "unexpected request"}
+	})
+}
+
+func newRefresherClient(t *testing.T, storage AppStorage, appids []string) *OpenClient {
+	oc := newTestOpenClient(t, &OpenClientConfigs{AppStorage: storage})
+	err := oc.configs.ComponentStorage.SaveAccessToken(&ExpireData{Value: "component_token", ExpiredAt: Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, appid := range appids {
+		// token 已过期, 需要刷新
+		err = oc.configs.ComponentStorage.SaveAppAccessToken(appid, &AppAccessToken{AccessToken: "expired", RefreshToken: "refresh_" + appid})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return oc
+}
+
+func TestRefreshTokens(t *testing.T) {
+	appids := []string{"wx_invalid", "wx_unauthorized", "wx_busy"}
+	for i := 0; i < 9; i++ {
+		appids = append(appids, fmt.Sprintf("wx_%d", i))
+	}
+	var running, maxRunning int32
+	mockAuthorizerToken(t, appids, &running, &maxRunning)
+	storage := NewMemoryStorage()
+	for _, appid := range appids {
+		_ = storage.SaveAppInfo(appid, &open_platform.AuthorizerInfo{NickName: appid})
+	}
+	oc := newRefresherClient(t, storage, appids)
+	report := oc.RefreshTokens(TokenRefresherOptions{Concurrency: 3, Jitter: time.Millisecond})
+	if report.ComponentErr != nil {
+		t.Fatal(report.ComponentErr)
+	}
+	// 并发数不超过 Concurrency
+	if m := atomic.LoadInt32(&maxRunning); m > 3 || m < 2 {
+		t.Errorf("need concurrency 2-3, got: %d", m)
+	}
+	sort.Strings(report.Invalid)
+	if report.Total != len(appids) || jsonStr(report.Invalid) != `["wx_invalid","wx_unauthorized"]` {
+		t.Errorf("unexpected report: %d %v", report.Total, report.Invalid)
+	}
+	if len(report.Errors) != 1 || report.Errors["wx_busy"] == nil {
+		t.Errorf("unexpected errors: %v", report.Errors)
+	}
+	for i := 0; i < 9; i++ {
+		appid := fmt.Sprintf("wx_%d", i)
+		token, err := oc.configs.ComponentStorage.GetAppAccessToken(appid)
+		if err != nil || token == nil || token.AccessToken != "token_"+appid {
+			t.Errorf("token of %s not refreshed: %+v, %v", appid, token, err)
+		}
+	}
+}
+
+// 未实现 AppidLister 的存储器
+type appStorageOnly struct {
+	AppStorage
+}
+
+func TestRefreshTokensAuthorizerList(t *testing.T) {
+	appids := []string{"wx_a", "wx_b"}
+	var running, maxRunning int32
+	mockAuthorizerToken(t, appids, &running, &maxRunning)
+	oc := newRefresherClient(t, appStorageOnly{NewMemoryStorage()}, appids)
+	var reports []*TokenRefreshReport
+	var mu sync.Mutex
+	stop := oc.StartTokenRefresher(TokenRefresherOptions{
+		OnReport: func(report *TokenRefreshReport) {
+			mu.Lock()
+			defer mu.Unlock()
+			reports = append(reports, report)
+		},
+	})
+	defer stop()
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(reports) > 0
+	})
+	mu.Lock()
+	report := reports[0]
+	mu.Unlock()
+	// 通过开放平台接口拉取已授权的公众号
+	if report.ComponentErr != nil || report.Total != 2 || len(report.Errors) != 0 {
+		t.Fatalf("unexpected report: %s", jsonStr(report))
+	}
+	for _, appid := range appids {
+		if token, _ := oc.configs.ComponentStorage.GetAppAccessToken(appid); token == nil || token.AccessToken != "token_"+appid {
+			t.Errorf("token of %s not refreshed: %+v", appid, token)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package src
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/morgine/wechat_sdk/pkg"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 远程 token 数据
+type RemoteToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiredAt   int64  `json:"expired_at"` // 过期时间(已提前), unix 时间戳
+}
+
+// token 服务, 由唯一持有三方平台密钥及 ComponentStorage 的服务提供三方平台及公众号 access token,
+// 其他服务通过 RemoteTokenClient 获取 token.
+//
+// 请求方式: GET {url}?appid={appid}, appid 为空时获得三方平台 token.
+// 成功时响应 RemoteToken, 失败时响应 {"errcode": code, "errmsg": msg}
+type TokenServer struct {
+	oc      *OpenClient
+	configs *TokenServerConfigs
+}
+
+// Secret 及 RequireClientCert 至少需要设置一个
+type TokenServerConfigs struct {
+	// 共享密钥, 客户端需携带请求头 Authorization: Bearer {Secret}, 为空时不校验
+	Secret string
+
+	// 是否要求 mTLS 客户端证书, 需同时在 http.Server 的 tls.Config 中设置 ClientCAs 及
+	// ClientAuth(tls.RequireAndVerifyClientCert)
+	RequireClientCert bool
+}
+
+// 存储器中读取不到刚刷新的 token 时(如存储器写入延迟), 响应的 token 过期时间
+const remoteTokenFallbackTTL = time.Minute
+
+func NewTokenServer(oc *OpenClient, configs *TokenServerConfigs) (*TokenServer, error) {
+	if configs.Secret == "" && !configs.RequireClientCert {
+		return nil, errors.New("token server requires Secret or RequireClientCert")
+	}
+	return &TokenServer{oc: oc, configs: configs}, nil
+}
+
+func (ts *TokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !ts.authorized(r) {
+		ts.writeJSON(w, http.StatusUnauthorized, &pkg.Error{ErrCode: http.StatusUnauthorized, ErrMsg: "unauthorized"})
+		return
+	}
+	token, err := ts.getToken(r.URL.Query().Get("appid"))
+	if err != nil {
+		ts.oc.configs.Logger.Println(err)
+		if werr, ok := err.(*pkg.Error); ok {
+			ts.writeJSON(w, http.StatusOK, werr)
+		} else {
+			ts.writeJSON(w, http.StatusInternalServerError, &pkg.Error{ErrCode: -1, ErrMsg: err.Error()})
+		}
+		return
+	}
+	ts.writeJSON(w, http.StatusOK, token)
+}
+
+// 未设置任何校验方式时拒绝所有请求
+func (ts *TokenServer) authorized(r *http.Request) bool {
+	if ts.configs.Secret == "" && !ts.configs.RequireClientCert {
+		return false
+	}
+	if ts.configs.RequireClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return false
+	}
+	if ts.configs.Secret != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return false
+		}
+		secret := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(ts.configs.Secret)) != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// 获得 token 及其过期时间, 优先返回存储器中未过期的 token, 过期时刷新后重新读取
+func (ts *TokenServer) getToken(appid string) (*RemoteToken, error) {
+	rt, err := ts.loadToken(appid)
+	if err != nil || rt != nil {
+		return rt, err
+	}
+	var token string
+	if appid == "" {
+		token, err = ts.oc.getComponentAccessToken()
+	} else {
+		token, err = ts.oc.getAppAccessToken(appid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rt, err = ts.loadToken(appid)
+	if err != nil {
+		return nil, err
+	}
+	if rt == nil || rt.AccessToken != token {
+		rt = &RemoteToken{AccessToken: token, ExpiredAt: Now().Add(remoteTokenFallbackTTL).Unix()}
+	}
+	return rt, nil
+}
+
+// 读取存储器中未过期的 token, 不存在或已过期时返回 nil
+func (ts *TokenServer) loadToken(appid string) (*RemoteToken, error) {
+	rt := &RemoteToken{}
+	if appid == "" {
+		data, err := ts.oc.configs.ComponentStorage.GetAccessToken()
+		if err != nil || data == nil {
+			return nil, err
+		}
+		rt.AccessToken, rt.ExpiredAt = data.Value, data.ExpiredAt
+	} else {
+		data, err := ts.oc.configs.ComponentStorage.GetAppAccessToken(appid)
+		if err != nil || data == nil {
+			return nil, err
+		}
+		rt.AccessToken, rt.ExpiredAt = data.AccessToken, data.ExpireAt
+	}
+	if rt.AccessToken == "" || rt.ExpiredAt < Now().Unix() {
+		return nil, nil
+	}
+	return rt, nil
+}
+
+func (ts *TokenServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// 远程 token 客户端, 从 TokenServer 获取 token 并缓存至过期
+type RemoteTokenClient struct {
+	configs *RemoteTokenConfigs
+	tokens  map[string]*RemoteToken
+	flights flightGroup
+	mu      sync.Mutex
+}
+
+type RemoteTokenConfigs struct {
+	Url    string       // TokenServer 地址
+	Secret string       // 共享密钥
+	Client *http.Client // http 客户端, 使用 mTLS 时需配置客户端证书, 为 nil 时使用 http.DefaultClient
+}
+
+func NewRemoteTokenClient(configs *RemoteTokenConfigs) *RemoteTokenClient {
+	if configs.Client == nil {
+		configs.Client = http.DefaultClient
+	}
+	return &RemoteTokenClient{
+		configs: configs,
+		tokens:  map[string]*RemoteToken{},
+	}
+}
+
+// 获得三方平台 access token 提供器
+func (c *RemoteTokenClient) ComponentTokenGetter() AccessTokenGetter {
+	return func() (token string, err error) {
+		return c.GetAccessToken("")
+	}
+}
+
+// 获得公众号 access token 提供器, 可用于 PublicClientConfigs.TokenGetter
+func (c *RemoteTokenClient) AppTokenGetter(appid string) AccessTokenGetter {
+	return func() (token string, err error) {
+		return c.GetAccessToken(appid)
+	}
+}
+
+// 获得 access token, appid 为空时获得三方平台 access token
+func (c *RemoteTokenClient) GetAccessToken(appid string) (string, error) {
+	c.mu.Lock()
+	token, ok := c.tokens[appid]
+	c.mu.Unlock()
+	if ok && token.ExpiredAt >= Now().Unix() {
+		return token.AccessToken, nil
+	}
+	return c.flights.do(appid, func() (string, error) {
+		token, err := c.fetch(appid)
+		if err != nil {
+			return "", err
+		}
+		c.mu.Lock()
+		c.tokens[appid] = token
+		c.mu.Unlock()
+		return token.AccessToken, nil
+	})
+}
+
+func (c *RemoteTokenClient) fetch(appid string) (*RemoteToken, error) {
+	u := c.configs.Url
+	if appid != "" {
+		if strings.Contains(u, "?") {
+			u += "&appid=" + url.QueryEscape(appid)
+		} else {
+			u += "?appid=" + url.QueryEscape(appid)
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.configs.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.configs.Secret)
+	}
+	resp, err := c.configs.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	werr := &pkg.Error{}
+	if json.Unmarshal(data, werr) == nil && werr.ErrCode != 0 {
+		return nil, werr
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token server: %s", resp.Status)
+	}
+	token := &RemoteToken{}
+	err = json.Unmarshal(data, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
@@ -0,0 +1,103 @@
+package src
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenServer(t *testing.T) {
+	storage := NewComponentStorage("component", NewMemoryStorage())
+	expiredAt := time.Now().Add(time.Hour).Unix()
+	if err := storage.SaveAccessToken(&ExpireData{Value: "component_token", ExpiredAt: expiredAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveAppAccessToken("wx_app", &AppAccessToken{AccessToken: "app_token", ExpireAt: expiredAt, RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	oc := &OpenClient{configs: &OpenClientConfigs{
+		Appid:            "component",
+		ComponentStorage: storage,
+		Logger:           log.New(os.Stderr, "", log.LstdFlags),
+	}}
+	ts, err := NewTokenServer(oc, &TokenServerConfigs{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	client := NewRemoteTokenClient(&RemoteTokenConfigs{Url: server.URL, Secret: "secret"})
+	for appid, need := range map[string]string{"": "component_token", "wx_app": "app_token"} {
+		got, err := client.GetAccessToken(appid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != need {
+			t.Errorf("need: %s, got: %s", need, got)
+		}
+	}
+	if token := client.tokens["wx_app"]; token == nil || token.ExpiredAt != expiredAt {
+		t.Errorf("token not cached: %+v", token)
+	}
+
+	_, err = NewRemoteTokenClient(&RemoteTokenConfigs{Url: server.URL, Secret: "wrong"}).GetAccessToken("")
+	if err == nil {
+		t.Error("need unauthorized error")
+	}
+}
+
+func TestTokenServerUnauthorized(t *testing.T) {
+	if _, err := NewTokenServer(&OpenClient{}, &TokenServerConfigs{}); err == nil {
+		t.Error("need error without Secret or RequireClientCert")
+	}
+	storage := NewComponentStorage("component", NewMemoryStorage())
+	_ = storage.SaveAccessToken(&ExpireData{Value: "component_token", ExpiredAt: time.Now().Add(time.Hour).Unix()})
+	oc := &OpenClient{configs: &OpenClientConfigs{Appid: "component", ComponentStorage: storage}}
+	for name, configs := range map[string]*TokenServerConfigs{
+		"secret":      {Secret: "secret"},
+		"client cert": {RequireClientCert: true},
+		"empty":       {}, // 未通过 NewTokenServer 创建时拒绝所有请求
+	} {
+		ts := &TokenServer{oc: oc, configs: configs}
+		recorder := httptest.NewRecorder()
+		ts.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/token", nil))
+		if recorder.Code != http.StatusUnauthorized || strings.Contains(recorder.Body.String(), "component_token") {
+			t.Errorf("%s: need 401, got: %d %s", name, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+// 不保存 access token 的存储器
+type discardTokenStorage struct {
+	ComponentStorage
+}
+
+func (discardTokenStorage) SaveAccessToken(data *ExpireData) error {
+	return nil
+}
+
+func TestTokenServerExpiredAt(t *testing.T) {
+	mockWechatAPI(t, func(r *http.Request, body []byte) interface{} {
+		return map[string]interface{}{"component_access_token": "component_token", "expires_in": 7200}
+	})
+	storage := discardTokenStorage{NewComponentStorage("component", NewMemoryStorage())}
+	_ = storage.SaveVerifyTicket("ticket")
+	oc := &OpenClient{configs: &OpenClientConfigs{Appid: "component", ComponentStorage: storage}}
+	ts, err := NewTokenServer(oc, &TokenServerConfigs{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 存储器中读取不到刷新后的 token 时, 仍响应有效的过期时间
+	token, err := ts.getToken("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "component_token" || token.ExpiredAt < Now().Unix() {
+		t.Errorf("unexpected token: %+v", token)
+	}
+}
@@ -0,0 +1,129 @@
+package src
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/morgine/wechat_sdk/pkg"
+	"github.com/morgine/wechat_sdk/pkg/message"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// 模拟微信接口, 根据请求返回响应数据, 响应数据将被编码为 JSON
+type wechatAPI func(r *http.Request, body []byte) interface{}
+
+func (f wechatAPI) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+	out, err := json.Marshal(f(r, body))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(string(out))),
+		Request:    r,
+	}, nil
+}
+
+// 模拟拉取已授权公众号列表接口的响应, 第一页返回所有公众号, refresh token 为 "refresh_" + appid
+func authorizerListResponse(appids []string, body []byte) interface{} {
+	data := map[string]interface{}{}
+	_ = json.Unmarshal(body, &data)
+	var list []map[string]string
+	if fmt.Sprint(data["offset"]) == "0" {
+		for _, appid := range appids {
+			list = append(list, map[string]string{"authorizer_appid": appid, "refresh_token": "refresh_" + appid})
+		}
+	}
+	return map[string]interface{}{"total_count": len(appids), "list": list}
+}
+
+// 创建测试用的三方平台客户端, 未设置的 Appid, AesKey 及存储器使用默认值
+func newTestOpenClient(t *testing.T, configs *OpenClientConfigs) *OpenClient {
+	t.Helper()
+	if configs.Appid == "" {
+		configs.Appid = "component"
+	}
+	if configs.AesKey == "" {
+		configs.AesKey = "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG"
+	}
+	if configs.ComponentStorage == nil {
+		configs.ComponentStorage = NewComponentStorage(configs.Appid, NewMemoryStorage())
+	}
+	if configs.AppStorage == nil {
+		configs.AppStorage = NewMemoryStorage()
+	}
+	oc, err := NewOpenClient(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oc
+}
+
+// 使用 handle 模拟所有微信接口, 测试结束后恢复
+func mockWechatAPI(t *testing.T, handle func(r *http.Request, body []byte) interface{}) {
+	transport := http.DefaultTransport
+	http.DefaultTransport = wechatAPI(handle)
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+	})
+}
+
+// 创建微信服务器推送的明文消息请求, token 为消息校验 token
+func newMessageRequest(token, xml string) *http.Request {
+	timestamp, nonce := "1600000000", "nonce"
+	q := url.Values{
+		"timestamp": {timestamp},
+		"nonce":     {nonce},
+		"signature": {pkg.SignParams(token, timestamp, nonce)},
+	}
+	return httptest.NewRequest(http.MethodPost, "/message?"+q.Encode(), strings.NewReader(xml))
+}
+
+// 创建三方平台代公众号接收的加密消息请求
+func newEncryptedMessageRequest(token string, msgCrypt *pkg.WXBizMsgCrypt, data string) *http.Request {
+	encrypted, err := msgCrypt.EncryptMsg([]byte(data), 1600000000, "nonce")
+	if err != nil {
+		panic(err)
+	}
+	body, _ := xml.Marshal(encrypted)
+	timestamp := fmt.Sprint(encrypted.TimeStamp)
+	q := url.Values{
+		"timestamp":     {timestamp},
+		"nonce":         {encrypted.Nonce},
+		"signature":     {pkg.SignParams(token, timestamp, encrypted.Nonce)},
+		"encrypt_type":  {"aes"},
+		"msg_signature": {encrypted.MsgSignature},
+	}
+	return httptest.NewRequest(http.MethodPost, "/message?"+q.Encode(), strings.NewReader(string(body)))
+}
+
+// 解密被动回复消息
+func decryptResponse(msgCrypt *pkg.WXBizMsgCrypt, body []byte) (*message.ResponseMessage, error) {
+	encrypted := &pkg.EncryptedMsg{}
+	if err := xml.Unmarshal(body, encrypted); err != nil {
+		return nil, err
+	}
+	data, err := msgCrypt.DecryptMsg(encrypted.MsgSignature, fmt.Sprint(encrypted.TimeStamp), encrypted.Nonce, body)
+	if err != nil {
+		return nil, err
+	}
+	res := &message.ResponseMessage{}
+	return res, xml.Unmarshal(data, res)
+}
+
+// 创建用户发送的文本消息
+func textMessageXML(openid, content string, msgId int64) string {
+	return fmt.Sprintf("<xml><ToUserName><![CDATA[gh_test]]></ToUserName><FromUserName><![CDATA[%s]]></FromUserName>"+
+		"<CreateTime>1600000000</CreateTime><MsgType><![CDATA[text]]></MsgType><Content><![CDATA[%s]]></Content>"+
+		"<MsgId>%d</MsgId></xml>", openid, content, msgId)
+}